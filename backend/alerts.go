@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ctaGetServiceBulletins = "getservicebulletins"
+	ctaGetDetours          = "getdetours"
+
+	alertKindBulletin = "bulletin"
+	alertKindDetour   = "detour"
+
+	// BusTime detour status: 1 is active, 0 means the detour was canceled.
+	ctaDetourActive = "1"
+
+	bulletinCacheTTLEnv     = "BULLETIN_CACHE_TTL"
+	defaultBulletinCacheTTL = 5 * time.Minute
+)
+
+type ctaBulletinService struct {
+	Rt    flexibleString `json:"rt"`
+	Rtdir flexibleString `json:"rtdir"`
+	Stpid flexibleString `json:"stpid"`
+	Stpnm flexibleString `json:"stpnm"`
+}
+
+type ctaServiceBulletin struct {
+	Nm    flexibleString       `json:"nm"`
+	Sbj   flexibleString       `json:"sbj"`
+	Dtl   flexibleString       `json:"dtl"`
+	Brf   flexibleString       `json:"brf"`
+	Cse   flexibleString       `json:"cse"`
+	Efct  flexibleString       `json:"efct"`
+	Prty  flexibleString       `json:"prty"`
+	Mod   flexibleString       `json:"mod"`
+	URL   flexibleString       `json:"url"`
+	Srvc  []ctaBulletinService `json:"srvc"`
+	Rtdir flexibleString       `json:"rtdir"`
+}
+
+type ctaServiceBulletinsResponse struct {
+	BustimeResponse struct {
+		Error     []ctaError           `json:"error,omitempty"`
+		Bulletins []ctaServiceBulletin `json:"sb,omitempty"`
+	} `json:"bustime-response"`
+}
+
+type ctaDetourRouteDirection struct {
+	Rt  flexibleString `json:"rt"`
+	Dir flexibleString `json:"dir"`
+}
+
+type ctaDetour struct {
+	ID      flexibleString            `json:"id"`
+	Ver     flexibleString            `json:"ver"`
+	St      flexibleString            `json:"st"`
+	Desc    flexibleString            `json:"desc"`
+	Rtdirs  []ctaDetourRouteDirection `json:"rtdirs"`
+	Startdt flexibleString            `json:"startdt"`
+	Enddt   flexibleString            `json:"enddt"`
+}
+
+type ctaDetoursResponse struct {
+	BustimeResponse struct {
+		Error   []ctaError  `json:"error,omitempty"`
+		Detours []ctaDetour `json:"dtrs,omitempty"`
+	} `json:"bustime-response"`
+}
+
+// alert is a service bulletin or detour normalized into one shape.
+// Severity is "high", "medium" or "low".
+type alert struct {
+	ID        string       `json:"id"`
+	Kind      string       `json:"kind"`
+	Title     string       `json:"title"`
+	Summary   string       `json:"summary,omitempty"`
+	Detail    string       `json:"detail,omitempty"`
+	Cause     string       `json:"cause,omitempty"`
+	Effect    string       `json:"effect,omitempty"`
+	Severity  string       `json:"severity"`
+	Routes    []alertRoute `json:"routes"`
+	Stops     []alertStop  `json:"stops"`
+	StartsAt  *time.Time   `json:"startsAt,omitempty"`
+	EndsAt    *time.Time   `json:"endsAt,omitempty"`
+	UpdatedAt *time.Time   `json:"updatedAt,omitempty"`
+	URL       string       `json:"url,omitempty"`
+}
+
+type alertRoute struct {
+	Route     string `json:"route"`
+	Direction string `json:"direction,omitempty"`
+}
+
+type alertStop struct {
+	StopID   string `json:"stopId"`
+	StopName string `json:"stopName,omitempty"`
+}
+
+// bulletinCache holds service bulletins in memory for ttl, keyed by the
+// batch of routes they were requested for. Listing every route always
+// produces the same batches, so /api/routes?bulletins=true and
+// /api/bulletins share their entries.
+type bulletinCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedBulletins
+}
+
+type cachedBulletins struct {
+	alerts    []alert
+	fetchedAt time.Time
+}
+
+func newBulletinCache(ttl time.Duration) *bulletinCache {
+	return &bulletinCache{ttl: ttl, entries: make(map[string]cachedBulletins)}
+}
+
+func (c *bulletinCache) get(key string) ([]alert, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Since(entry.fetchedAt) >= c.ttl {
+		return nil, false
+	}
+	return entry.alerts, true
+}
+
+// put stores alerts under key and drops expired entries, so one-off route
+// combinations don't accumulate.
+func (c *bulletinCache) put(key string, alerts []alert) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, entry := range c.entries {
+		if time.Since(entry.fetchedAt) >= c.ttl {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedBulletins{alerts: alerts, fetchedAt: time.Now()}
+}
+
+// GetServiceBulletins returns the bulletins affecting the given routes, or
+// every route when none are given. Batches are fetched concurrently, up to
+// the service's concurrency limit, and cached for BULLETIN_CACHE_TTL.
+func (s *CTAService) GetServiceBulletins(ctx context.Context, routeIDs []string) ([]alert, error) {
+	s.logger.Info("fetching service bulletins", "routes", routeIDs)
+
+	if len(routeIDs) == 0 {
+		routes, err := s.GetRoutes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range routes {
+			routeIDs = append(routeIDs, r.RouteNumber)
+		}
+	}
+
+	batches := batchIdentifiers(routeIDs, maxBustimeIdentifiers)
+	results, _, err := fanOut(ctx, s.maxConcurrency, batches, true, s.cachedServiceBulletins)
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := make([]alert, 0)
+	seen := make(map[string]bool)
+	for _, bulletins := range results {
+		// The same bulletin is returned for every route it affects, so drop repeats across batches.
+		for _, b := range bulletins {
+			if seen[b.ID] {
+				continue
+			}
+			seen[b.ID] = true
+			alerts = append(alerts, b)
+		}
+	}
+
+	s.logger.Info("successfully fetched service bulletins", "count", len(alerts))
+	return alerts, nil
+}
+
+// cachedServiceBulletins returns one batch's bulletins from the cache, or
+// fetches and caches them.
+func (s *CTAService) cachedServiceBulletins(ctx context.Context, routeIDs []string) ([]alert, error) {
+	if s.bulletinCache == nil {
+		return s.fetchServiceBulletins(ctx, routeIDs)
+	}
+	key := strings.Join(routeIDs, ",")
+	if alerts, ok := s.bulletinCache.get(key); ok {
+		return alerts, nil
+	}
+	alerts, err := s.fetchServiceBulletins(ctx, routeIDs)
+	if err != nil {
+		return nil, err
+	}
+	s.bulletinCache.put(key, alerts)
+	return alerts, nil
+}
+
+func (s *CTAService) fetchServiceBulletins(ctx context.Context, routeIDs []string) ([]alert, error) {
+	params := url.Values{}
+	params.Set("rt", strings.Join(routeIDs, ","))
+
+	var bulletinsResp ctaServiceBulletinsResponse
+	if err := s.fetch(ctx, ctaGetServiceBulletins, params, &bulletinsResp); err != nil {
+		return nil, err
+	}
+
+	if len(bulletinsResp.BustimeResponse.Bulletins) == 0 && len(bulletinsResp.BustimeResponse.Error) > 0 {
+		if isNoDataError(bulletinsResp.BustimeResponse.Error) {
+			return []alert{}, nil
+		}
+		s.logger.Error("CTA API returned error", "errors", bulletinsResp.BustimeResponse.Error)
+		return nil, newAPIError(http.StatusBadGateway, "CTA API returned error", bulletinsResp.BustimeResponse)
+	}
+
+	alerts := make([]alert, 0, len(bulletinsResp.BustimeResponse.Bulletins))
+	for _, b := range bulletinsResp.BustimeResponse.Bulletins {
+		a := alert{
+			ID:        string(b.Nm),
+			Kind:      alertKindBulletin,
+			Title:     string(b.Sbj),
+			Summary:   string(b.Brf),
+			Detail:    string(b.Dtl),
+			Cause:     string(b.Cse),
+			Effect:    string(b.Efct),
+			Severity:  normalizeSeverity(string(b.Prty)),
+			Routes:    make([]alertRoute, 0),
+			Stops:     make([]alertStop, 0),
+			UpdatedAt: parseOptionalCTATime(string(b.Mod)),
+			URL:       string(b.URL),
+		}
+		if a.ID == "" {
+			a.ID = a.Title
+		}
+		for _, svc := range b.Srvc {
+			if svc.Rt != "" {
+				a.Routes = append(a.Routes, alertRoute{Route: string(svc.Rt), Direction: string(svc.Rtdir)})
+			}
+			if svc.Stpid != "" {
+				a.Stops = append(a.Stops, alertStop{StopID: string(svc.Stpid), StopName: string(svc.Stpnm)})
+			}
+		}
+		alerts = append(alerts, a)
+	}
+
+	s.trackCall(ctaGetServiceBulletins)
+	return alerts, nil
+}
+
+// GetDetours returns active detours for the given routes, or for all routes
+// when none are given.
+func (s *CTAService) GetDetours(ctx context.Context, routeIDs []string) ([]alert, error) {
+	s.logger.Info("fetching detours", "routes", routeIDs)
+
+	wanted := make(map[string]bool, len(routeIDs))
+	for _, rt := range routeIDs {
+		wanted[rt] = true
+	}
+
+	var detoursResp ctaDetoursResponse
+	if err := s.fetch(ctx, ctaGetDetours, nil, &detoursResp); err != nil {
+		return nil, err
+	}
+
+	if len(detoursResp.BustimeResponse.Detours) == 0 && len(detoursResp.BustimeResponse.Error) > 0 {
+		if isNoDataError(detoursResp.BustimeResponse.Error) {
+			s.logger.Info("no detours found")
+			return []alert{}, nil
+		}
+		s.logger.Error("CTA API returned error", "errors", detoursResp.BustimeResponse.Error)
+		return nil, newAPIError(http.StatusBadGateway, "CTA API returned error", detoursResp.BustimeResponse)
+	}
+
+	alerts := make([]alert, 0, len(detoursResp.BustimeResponse.Detours))
+	for _, d := range detoursResp.BustimeResponse.Detours {
+		if d.St != ctaDetourActive {
+			continue
+		}
+		a := alert{
+			ID:       string(d.ID),
+			Kind:     alertKindDetour,
+			Title:    string(d.Desc),
+			Severity: "medium",
+			Routes:   make([]alertRoute, 0, len(d.Rtdirs)),
+			Stops:    make([]alertStop, 0),
+			StartsAt: parseOptionalCTATime(string(d.Startdt)),
+			EndsAt:   parseOptionalCTATime(string(d.Enddt)),
+		}
+		matches := len(wanted) == 0
+		for _, rd := range d.Rtdirs {
+			a.Routes = append(a.Routes, alertRoute{Route: string(rd.Rt), Direction: string(rd.Dir)})
+			matches = matches || wanted[string(rd.Rt)]
+		}
+		if matches {
+			alerts = append(alerts, a)
+		}
+	}
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].ID < alerts[j].ID })
+
+	s.logger.Info("successfully fetched detours", "count", len(alerts))
+	s.trackCall(ctaGetDetours)
+	return alerts, nil
+}
+
+// GetRoutesWithBulletins returns the route list with HasBulletins set on each route.
+func (s *CTAService) GetRoutesWithBulletins(ctx context.Context) ([]route, error) {
+	routes, err := s.GetRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	routeIDs := make([]string, len(routes))
+	for i, r := range routes {
+		routeIDs[i] = r.RouteNumber
+	}
+	bulletins, err := s.GetServiceBulletins(ctx, routeIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	affected := make(map[string]bool)
+	for _, b := range bulletins {
+		for _, r := range b.Routes {
+			affected[r.Route] = true
+		}
+	}
+	for i := range routes {
+		hasBulletins := affected[routes[i].RouteNumber]
+		routes[i].HasBulletins = &hasBulletins
+	}
+	return routes, nil
+}
+
+// normalizeSeverity maps BusTime priorities ("High", "Medium", "Low") onto
+// lowercase severities, treating anything unrecognized as "low".
+func normalizeSeverity(priority string) string {
+	switch strings.ToLower(strings.TrimSpace(priority)) {
+	case "high", "urgent":
+		return "high"
+	case "medium":
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+func parseOptionalCTATime(value string) *time.Time {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	t, err := parseCTATime(value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	staleAfterEnv = "VEHICLE_STALE_AFTER"
+	// BusTime normally refreshes positions every minute; data this old means
+	// the bus has stopped reporting but is still in the feed
+	defaultStaleAfter = 5 * time.Minute
+	idleAfterEnv      = "VEHICLE_IDLE_AFTER"
+	// Long enough to sit out a normal terminal layover
+	defaultIdleAfter = 15 * time.Minute
+)
+
+// vehicleJump is a vehicle whose reported position recently jumped.
+type vehicleJump struct {
+	vehicle
+	Jump positionJump `json:"jump"`
+}
+
+// vehicleAnomalies is the /api/vehicles/anomalies response. Stale vehicles
+// have data older than StaleAfterSeconds; idle vehicles are still reporting
+// but haven't moved for IdleAfterSeconds. Jumps lists vehicles whose position
+// moved implausibly far between two reports in the last few minutes.
+type vehicleAnomalies struct {
+	StaleAfterSeconds int           `json:"staleAfterSeconds"`
+	IdleAfterSeconds  int           `json:"idleAfterSeconds"`
+	Stale             []vehicle     `json:"stale"`
+	Idle              []vehicle     `json:"idle"`
+	Jumps             []vehicleJump `json:"jumps"`
+}
+
+// findAnomalies sorts out the stale, idle and jumping vehicles, each list
+// ordered worst first.
+func findAnomalies(vehicles []vehicle, staleAfter time.Duration, idleAfter time.Duration, recentJump func(vehicleID string) (positionJump, bool)) vehicleAnomalies {
+	result := vehicleAnomalies{
+		StaleAfterSeconds: int(staleAfter.Seconds()),
+		IdleAfterSeconds:  int(idleAfter.Seconds()),
+		Stale:             make([]vehicle, 0),
+		Idle:              make([]vehicle, 0),
+		Jumps:             make([]vehicleJump, 0),
+	}
+	for _, v := range vehicles {
+		switch {
+		case isStale(v, staleAfter):
+			result.Stale = append(result.Stale, v)
+		case tagSeconds(v.StationarySeconds) >= int(idleAfter.Seconds()):
+			result.Idle = append(result.Idle, v)
+		}
+		if jump, ok := recentJump(v.VehicleID); ok {
+			result.Jumps = append(result.Jumps, vehicleJump{vehicle: v, Jump: jump})
+		}
+	}
+
+	sort.Slice(result.Stale, func(i, j int) bool {
+		return worseFirst(tagSeconds(result.Stale[i].DataAgeSeconds), tagSeconds(result.Stale[j].DataAgeSeconds), result.Stale[i].VehicleID, result.Stale[j].VehicleID)
+	})
+	sort.Slice(result.Idle, func(i, j int) bool {
+		return worseFirst(tagSeconds(result.Idle[i].StationarySeconds), tagSeconds(result.Idle[j].StationarySeconds), result.Idle[i].VehicleID, result.Idle[j].VehicleID)
+	})
+	sort.Slice(result.Jumps, func(i, j int) bool {
+		return worseFirst(result.Jumps[i].Jump.DistanceFeet, result.Jumps[j].Jump.DistanceFeet, result.Jumps[i].VehicleID, result.Jumps[j].VehicleID)
+	})
+	return result
+}
+
+func worseFirst(a int, b int, vidA string, vidB string) bool {
+	if a != b {
+		return a > b
+	}
+	return vidA < vidB
+}
+
+// isStale reports whether the vehicle's data was at least staleAfter old
+// when it was fetched. Untagged vehicles are never stale.
+func isStale(v vehicle, staleAfter time.Duration) bool {
+	return v.DataAgeSeconds != nil && *v.DataAgeSeconds >= int(staleAfter.Seconds())
+}
+
+// tagSeconds returns a fetch tag's value, or 0 for an untagged vehicle.
+func tagSeconds(seconds *int) int {
+	if seconds == nil {
+		return 0
+	}
+	return *seconds
+}
+
+// withoutStale returns the vehicles whose data is fresher than staleAfter.
+func withoutStale(vehicles []vehicle, staleAfter time.Duration) []vehicle {
+	fresh := make([]vehicle, 0, len(vehicles))
+	for _, v := range vehicles {
+		if !isStale(v, staleAfter) {
+			fresh = append(fresh, v)
+		}
+	}
+	return fresh
+}
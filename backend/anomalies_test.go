@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMotionTrackerStationaryAndJumps(t *testing.T) {
+	report := func(timestamp string, lat string, lon string) []vehicle {
+		return []vehicle{{VehicleID: "1", PatternID: "100", PatternDistance: "1000", Latitude: lat, Longitude: lon, Timestamp: timestamp}}
+	}
+	now := time.Date(2024, 6, 12, 8, 30, 0, 0, chicagoLocation)
+
+	motion := newMotionTracker()
+	motion.observe(report("20240612 08:15", "41.88416", "-87.66630"))
+	// GPS jitter of a few feet doesn't count as moving
+	motion.observe(report("20240612 08:17", "41.88420", "-87.66632"))
+	motion.observe(report("20240612 08:20", "41.88416", "-87.66630"))
+
+	vehicles := report("20240612 08:20", "41.88416", "-87.66630")
+	motion.tag(vehicles, now)
+	if tagSeconds(vehicles[0].DataAgeSeconds) != 600 || tagSeconds(vehicles[0].StationarySeconds) != 300 {
+		t.Fatalf("expected 600s old and 300s stationary, got %+v", vehicles[0])
+	}
+	if _, ok := motion.recentJump("1"); ok {
+		t.Fatal("expected no jump while stationary")
+	}
+
+	// Driving a quarter mile in a minute resets the stationary clock
+	motion.observe(report("20240612 08:21", "41.88778", "-87.66630"))
+	motion.tag(vehicles, now)
+	if vehicles[0].StationarySeconds == nil || *vehicles[0].StationarySeconds != 0 {
+		t.Fatalf("expected the bus to be moving, got %+v", vehicles[0])
+	}
+	if _, ok := motion.recentJump("1"); ok {
+		t.Fatal("expected a plausible move not to count as a jump")
+	}
+
+	// Over four miles in a minute is a jump
+	motion.observe(report("20240612 08:22", "41.95402", "-87.66850"))
+	jump, ok := motion.recentJump("1")
+	if !ok || jump.DistanceFeet < 4*5280 || jump.Seconds != 60 || jump.FromLatitude != 41.88778 {
+		t.Fatalf("expected a jump of over four miles, got %+v (ok=%v)", jump, ok)
+	}
+
+	// The jump is forgotten once it is older than the motion window
+	motion.observe(report("20240612 08:26", "41.95402", "-87.66850"))
+	if _, ok := motion.recentJump("1"); !ok {
+		t.Fatal("expected the jump to still be recent")
+	}
+	motion.observe(report("20240612 08:28", "41.95402", "-87.66850"))
+	if _, ok := motion.recentJump("1"); ok {
+		t.Fatal("expected the jump to have expired")
+	}
+}
+
+func TestFindAnomalies(t *testing.T) {
+	vehicles := []vehicle{
+		{VehicleID: "1", DataAgeSeconds: seconds(30), StationarySeconds: seconds(60)},
+		{VehicleID: "2", DataAgeSeconds: seconds(900), StationarySeconds: seconds(1800)},
+		{VehicleID: "3", DataAgeSeconds: seconds(400)},
+		{VehicleID: "4", DataAgeSeconds: seconds(45), StationarySeconds: seconds(1200)},
+		{VehicleID: "5", DataAgeSeconds: seconds(20), StationarySeconds: seconds(900)},
+		// Untagged, like a train: neither stale nor idle
+		{VehicleID: "6"},
+	}
+	recentJump := func(vehicleID string) (positionJump, bool) {
+		return positionJump{DistanceFeet: 12000}, vehicleID == "1"
+	}
+
+	result := findAnomalies(vehicles, 5*time.Minute, 15*time.Minute, recentJump)
+	if result.StaleAfterSeconds != 300 || result.IdleAfterSeconds != 900 {
+		t.Fatalf("unexpected thresholds %+v", result)
+	}
+	// Stale vehicles aren't also listed as idle
+	if got := vehicleIDs(result.Stale); got != "2,3" {
+		t.Fatalf("expected stale 2,3, got %s", got)
+	}
+	if got := vehicleIDs(result.Idle); got != "4,5" {
+		t.Fatalf("expected idle 4,5, got %s", got)
+	}
+	if len(result.Jumps) != 1 || result.Jumps[0].VehicleID != "1" || result.Jumps[0].Jump.DistanceFeet != 12000 {
+		t.Fatalf("unexpected jumps %+v", result.Jumps)
+	}
+
+	if got := vehicleIDs(withoutStale(vehicles, 5*time.Minute)); got != "1,4,5,6" {
+		t.Fatalf("expected fresh 1,4,5,6, got %s", got)
+	}
+}
+
+func vehicleIDs(vehicles []vehicle) string {
+	ids := make([]string, 0, len(vehicles))
+	for _, v := range vehicles {
+		ids = append(ids, v.VehicleID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func seconds(n int) *int {
+	return &n
+}
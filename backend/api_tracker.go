@@ -7,8 +7,16 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Upstream APIs tracked separately, since each has its own key and daily limit.
+const (
+	apiTrackerDBPathEnv    = "API_TRACKER_DB_PATH"
+	trackedAPIBusTime      = "bustime"
+	trackedAPITrainTracker = "traintracker"
+)
+
 type APICall struct {
 	ID        int64     `json:"id"`
+	API       string    `json:"api"`
 	Endpoint  string    `json:"endpoint"`
 	CreatedAt time.Time `json:"createdAt"`
 }
@@ -44,18 +52,82 @@ func (t *APICallTracker) initSchema() error {
 		CREATE INDEX IF NOT EXISTS idx_api_calls_endpoint ON api_calls(endpoint);
 		CREATE INDEX IF NOT EXISTS idx_api_calls_created_at ON api_calls(created_at);
 	`)
+	if err != nil {
+		return err
+	}
+
+	// Databases created before Train Tracker support only hold BusTime calls.
+	hasAPIColumn, err := t.hasColumn("api_calls", "api")
+	if err != nil {
+		return err
+	}
+	if !hasAPIColumn {
+		if _, err := t.db.Exec(`ALTER TABLE api_calls ADD COLUMN api TEXT NOT NULL DEFAULT 'bustime'`); err != nil {
+			return err
+		}
+	}
+	_, err = t.db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_api_calls_api_created_at ON api_calls(api, created_at);
+		CREATE TABLE IF NOT EXISTS api_budget_usage (
+			api TEXT NOT NULL,
+			day TEXT NOT NULL,
+			used INTEGER NOT NULL,
+			PRIMARY KEY (api, day)
+		);
+	`)
 	return err
 }
 
+func (t *APICallTracker) hasColumn(table string, column string) (bool, error) {
+	rows, err := t.db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 func (t *APICallTracker) Close() error {
 	return t.db.Close()
 }
 
-func (t *APICallTracker) TrackCall(endpoint string) error {
-	_, err := t.db.Exec(`INSERT INTO api_calls (endpoint) VALUES (?)`, endpoint)
+// TrackCall records one call to endpoint of the given upstream API.
+func (t *APICallTracker) TrackCall(api string, endpoint string) error {
+	_, err := t.db.Exec(`INSERT INTO api_calls (api, endpoint) VALUES (?, ?)`, api, endpoint)
+	return err
+}
+
+// AddBudgetUsage counts n call attempts against an API's budget for day
+// (YYYY-MM-DD, UTC). Unlike TrackCall this includes retries, failures and
+// empty responses, so the budget survives restarts unchanged.
+func (t *APICallTracker) AddBudgetUsage(api string, day string, n int64) error {
+	_, err := t.db.Exec(`
+		INSERT INTO api_budget_usage (api, day, used) VALUES (?, ?, ?)
+		ON CONFLICT (api, day) DO UPDATE SET used = used + excluded.used
+	`, api, day, n)
 	return err
 }
 
+// GetBudgetUsage returns the call attempts counted against an API's budget for day.
+func (t *APICallTracker) GetBudgetUsage(api string, day string) (int64, error) {
+	var used int64
+	err := t.db.QueryRow(`SELECT used FROM api_budget_usage WHERE api = ? AND day = ?`, api, day).Scan(&used)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return used, err
+}
+
 // GetTotalCount returns the total number of API calls
 func (t *APICallTracker) GetTotalCount() (int64, error) {
 	var count int64
@@ -96,3 +168,38 @@ func (t *APICallTracker) GetCountToday() (int64, error) {
 	`).Scan(&count)
 	return count, err
 }
+
+// GetCountTodayForAPI returns the number of calls made today to one upstream API
+func (t *APICallTracker) GetCountTodayForAPI(api string) (int64, error) {
+	var count int64
+	err := t.db.QueryRow(`
+		SELECT COUNT(*) FROM api_calls
+		WHERE api = ? AND date(created_at) = date('now')
+	`, api).Scan(&count)
+	return count, err
+}
+
+// GetCountTodayByAPI returns the number of API calls made today grouped by upstream API
+func (t *APICallTracker) GetCountTodayByAPI() (map[string]int64, error) {
+	rows, err := t.db.Query(`
+		SELECT api, COUNT(*) as call_count
+		FROM api_calls
+		WHERE date(created_at) = date('now')
+		GROUP BY api
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make(map[string]int64)
+	for rows.Next() {
+		var api string
+		var count int64
+		if err := rows.Scan(&api, &count); err != nil {
+			return nil, err
+		}
+		results[api] = count
+	}
+	return results, rows.Err()
+}
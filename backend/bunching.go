@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	bunchingThresholdEnv = "BUNCHING_THRESHOLD_FEET"
+	// A quarter mile: closer than this, two buses on the same pattern are
+	// effectively running as one
+	defaultBunchingThreshold = 1320
+)
+
+// busBunch is a run of buses on one pattern, each less than the threshold
+// behind the one ahead of it. Vehicles are ordered from the front of the
+// pattern (highest pdist) back, and GapsFeet[i] is the distance between
+// vehicles i and i+1.
+type busBunch struct {
+	Route       string   `json:"route"`
+	PatternID   string   `json:"patternId"`
+	Destination string   `json:"destination"`
+	VehicleIDs  []string `json:"vehicleIds"`
+	GapsFeet    []int    `json:"gapsFeet"`
+	SpanFeet    int      `json:"spanFeet"`
+}
+
+// routeBunching is the /api/routes/:route/bunching response.
+type routeBunching struct {
+	Route           string     `json:"route"`
+	ThresholdFeet   int        `json:"thresholdFeet"`
+	Bunches         []busBunch `json:"bunches"`
+	BunchedVehicles int        `json:"bunchedVehicles"`
+}
+
+// patternPosition is a vehicle's progress along its pattern.
+type patternPosition struct {
+	vehicle vehicle
+	pdist   int
+}
+
+// vehiclesByPattern groups vehicles by pattern and orders each group from
+// the front of the pattern back. Vehicles without a usable pattern distance
+// are left out, as are buses that haven't left the first stop (pdist 0),
+// since several buses laying over at a terminal aren't bunched.
+func vehiclesByPattern(vehicles []vehicle) map[string][]patternPosition {
+	byPattern := make(map[string][]patternPosition)
+	for _, v := range vehicles {
+		if v.PatternID == "" {
+			continue
+		}
+		pdist, err := strconv.Atoi(strings.TrimSpace(v.PatternDistance))
+		if err != nil || pdist <= 0 {
+			continue
+		}
+		byPattern[v.PatternID] = append(byPattern[v.PatternID], patternPosition{vehicle: v, pdist: pdist})
+	}
+	for _, positions := range byPattern {
+		sort.Slice(positions, func(i, j int) bool {
+			if positions[i].pdist != positions[j].pdist {
+				return positions[i].pdist > positions[j].pdist
+			}
+			return positions[i].vehicle.VehicleID < positions[j].vehicle.VehicleID
+		})
+	}
+	return byPattern
+}
+
+// detectBunching finds buses on the same pattern that are closer together
+// than thresholdFeet. Bunches are ordered by route, pattern and lead vehicle.
+func detectBunching(vehicles []vehicle, thresholdFeet int) []busBunch {
+	bunches := make([]busBunch, 0)
+	for patternID, positions := range vehiclesByPattern(vehicles) {
+		var current *busBunch
+		for i := 1; i < len(positions); i++ {
+			ahead, behind := positions[i-1], positions[i]
+			gap := ahead.pdist - behind.pdist
+			if gap >= thresholdFeet {
+				current = nil
+				continue
+			}
+			if current == nil {
+				bunches = append(bunches, busBunch{
+					Route:       ahead.vehicle.Route,
+					PatternID:   patternID,
+					Destination: ahead.vehicle.Destination,
+					VehicleIDs:  []string{ahead.vehicle.VehicleID},
+					GapsFeet:    []int{},
+				})
+				current = &bunches[len(bunches)-1]
+			}
+			current.VehicleIDs = append(current.VehicleIDs, behind.vehicle.VehicleID)
+			current.GapsFeet = append(current.GapsFeet, gap)
+			current.SpanFeet += gap
+		}
+	}
+
+	sort.Slice(bunches, func(i, j int) bool {
+		if bunches[i].Route != bunches[j].Route {
+			return bunches[i].Route < bunches[j].Route
+		}
+		if bunches[i].PatternID != bunches[j].PatternID {
+			return bunches[i].PatternID < bunches[j].PatternID
+		}
+		return bunches[i].VehicleIDs[0] < bunches[j].VehicleIDs[0]
+	})
+	return bunches
+}
+
+// countBunchedVehicles returns how many vehicles are part of any bunch.
+func countBunchedVehicles(bunches []busBunch) int {
+	count := 0
+	for _, b := range bunches {
+		count += len(b.VehicleIDs)
+	}
+	return count
+}
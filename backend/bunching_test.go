@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectBunching(t *testing.T) {
+	vehicles := []vehicle{
+		{VehicleID: "1", Route: "9", PatternID: "100", PatternDistance: "20000", Destination: "95th Street"},
+		{VehicleID: "2", Route: "9", PatternID: "100", PatternDistance: "19500"},
+		{VehicleID: "3", Route: "9", PatternID: "100", PatternDistance: "18700"},
+		{VehicleID: "4", Route: "9", PatternID: "100", PatternDistance: "9000"},
+		// Close to 4, but heading the other way
+		{VehicleID: "5", Route: "9", PatternID: "101", PatternDistance: "9100"},
+		// Laying over at the terminal, or with no usable position
+		{VehicleID: "6", Route: "9", PatternID: "100", PatternDistance: "0"},
+		{VehicleID: "7", Route: "9", PatternID: "100", PatternDistance: ""},
+		{VehicleID: "8", Route: "9", PatternID: "101", PatternDistance: "0"},
+		{VehicleID: "9", Route: "22", PatternID: "200", PatternDistance: "5000", Destination: "Howard"},
+		{VehicleID: "10", Route: "22", PatternID: "200", PatternDistance: "5000", Destination: "Howard"},
+	}
+
+	bunches := detectBunching(vehicles, 1000)
+	want := []busBunch{
+		{Route: "22", PatternID: "200", Destination: "Howard", VehicleIDs: []string{"10", "9"}, GapsFeet: []int{0}, SpanFeet: 0},
+		{Route: "9", PatternID: "100", Destination: "95th Street", VehicleIDs: []string{"1", "2", "3"}, GapsFeet: []int{500, 800}, SpanFeet: 1300},
+	}
+	if !reflect.DeepEqual(bunches, want) {
+		t.Fatalf("expected %+v, got %+v", want, bunches)
+	}
+	if count := countBunchedVehicles(bunches); count != 5 {
+		t.Fatalf("expected 5 bunched vehicles, got %d", count)
+	}
+
+	// Gaps equal to the threshold don't count
+	if bunches := detectBunching(vehicles, 500); len(bunches) != 1 || bunches[0].Route != "22" {
+		t.Fatalf("expected only the route 22 pair, got %+v", bunches)
+	}
+}
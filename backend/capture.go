@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	captureDirEnv = "CTA_CAPTURE_DIR"
+	// scrubbedKey replaces the API key wherever it appears in a capture.
+	// Keys shorter than minScrubbedKeyLength (test keys) are only dropped from
+	// the query, since replacing them would mangle ordinary text.
+	scrubbedKey          = "REDACTED"
+	minScrubbedKeyLength = 8
+)
+
+// captureEntry is one recorded BusTime exchange, stored as its own JSON file.
+// Query is the request's query string without key and format, so captures
+// can be shared and replayed without an API key. Body holds the response as
+// JSON, or Text when the response wasn't JSON.
+type captureEntry struct {
+	RecordedAt time.Time       `json:"recordedAt"`
+	Endpoint   string          `json:"endpoint"`
+	Query      string          `json:"query"`
+	Status     int             `json:"status"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Text       string          `json:"text,omitempty"`
+}
+
+// body returns the response body as served.
+func (e captureEntry) body() []byte {
+	if len(e.Body) > 0 {
+		return e.Body
+	}
+	return []byte(e.Text)
+}
+
+// captureQuery removes the parameters that don't identify a request (the
+// API key and response format) and returns the rest in canonical order.
+func captureQuery(query url.Values) string {
+	cleaned := url.Values{}
+	for key, values := range query {
+		if key == "key" || key == "format" {
+			continue
+		}
+		cleaned[key] = values
+	}
+	return cleaned.Encode()
+}
+
+// captureTransport is an http.RoundTripper that passes BusTime requests to
+// next and writes each exchange to dir, one file per response, with the API
+// key scrubbed. Exchanges that fail before a response arrives aren't
+// recorded.
+type captureTransport struct {
+	dir    string
+	next   http.RoundTripper
+	logger *slog.Logger
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newCaptureTransport(dir string, next http.RoundTripper, logger *slog.Logger) (*captureTransport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &captureTransport{dir: dir, next: next, logger: logger}, nil
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry := captureEntry{
+		RecordedAt: time.Now().In(chicagoLocation),
+		Endpoint:   path.Base(req.URL.Path),
+		Query:      captureQuery(req.URL.Query()),
+		Status:     resp.StatusCode,
+	}
+	if key := req.URL.Query().Get("key"); len(key) >= minScrubbedKeyLength {
+		body = bytes.ReplaceAll(body, []byte(key), []byte(scrubbedKey))
+	}
+	if json.Valid(body) {
+		entry.Body = body
+	} else {
+		entry.Text = string(body)
+	}
+	if err := t.write(entry); err != nil {
+		t.logger.Warn("failed to write BusTime capture", "endpoint", entry.Endpoint, "error", err)
+	}
+	return resp, nil
+}
+
+// write stores entry under a name that sorts by recording time.
+func (t *captureTransport) write(entry captureEntry) error {
+	t.mu.Lock()
+	t.seq++
+	seq := t.seq
+	t.mu.Unlock()
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%06d-%s.json", entry.RecordedAt.UTC().Format("20060102T150405.000"), seq, strings.ReplaceAll(entry.Endpoint, string(filepath.Separator), "_"))
+	return os.WriteFile(filepath.Join(t.dir, name), data, 0o644)
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ctaGetDirections           = "getdirections"
+	ctaGetStops                = "getstops"
+	ctaGetPatterns             = "getpatterns"
+	catalogDBPathEnv           = "CATALOG_DB_PATH"
+	catalogCacheTTLEnv         = "CATALOG_CACHE_TTL"
+	defaultCatalogCacheTTL     = 7 * 24 * time.Hour
+	catalogDirectionsPrefix    = "directions:"
+	catalogStopsPrefix         = "stops:"
+	catalogPatternPrefix       = "pattern:"
+	catalogRoutePatternsPrefix = "patterns:"
+)
+
+// flexibleFloat accepts JSON numbers or numeric strings.
+type flexibleFloat float64
+
+func (f *flexibleFloat) UnmarshalJSON(b []byte) error {
+	var s flexibleString
+	if err := s.UnmarshalJSON(b); err != nil {
+		return err
+	}
+	if s == "" || s == "null" {
+		return nil
+	}
+	v, err := strconv.ParseFloat(string(s), 64)
+	if err != nil {
+		return fmt.Errorf("flexibleFloat: %w", err)
+	}
+	*f = flexibleFloat(v)
+	return nil
+}
+
+type ctaDirection struct {
+	ID   flexibleString `json:"id"`
+	Name flexibleString `json:"name"`
+}
+
+type ctaDirectionsResponse struct {
+	BustimeResponse struct {
+		Error      []ctaError     `json:"error,omitempty"`
+		Directions []ctaDirection `json:"directions,omitempty"`
+	} `json:"bustime-response"`
+}
+
+type ctaStop struct {
+	Stpid flexibleString `json:"stpid"`
+	Stpnm flexibleString `json:"stpnm"`
+	Lat   flexibleFloat  `json:"lat"`
+	Lon   flexibleFloat  `json:"lon"`
+}
+
+type ctaStopsResponse struct {
+	BustimeResponse struct {
+		Error []ctaError `json:"error,omitempty"`
+		Stops []ctaStop  `json:"stops,omitempty"`
+	} `json:"bustime-response"`
+}
+
+type ctaPatternPoint struct {
+	Seq   flexibleFloat  `json:"seq"`
+	Lat   flexibleFloat  `json:"lat"`
+	Lon   flexibleFloat  `json:"lon"`
+	Typ   flexibleString `json:"typ"`
+	Stpid flexibleString `json:"stpid"`
+	Stpnm flexibleString `json:"stpnm"`
+	Pdist flexibleFloat  `json:"pdist"`
+}
+
+type ctaPattern struct {
+	Pid   flexibleString    `json:"pid"`
+	Ln    flexibleFloat     `json:"ln"`
+	Rtdir flexibleString    `json:"rtdir"`
+	Pt    []ctaPatternPoint `json:"pt"`
+}
+
+type ctaPatternsResponse struct {
+	BustimeResponse struct {
+		Error    []ctaError   `json:"error,omitempty"`
+		Patterns []ctaPattern `json:"ptr,omitempty"`
+	} `json:"bustime-response"`
+}
+
+// direction is a route direction as named by BusTime, e.g. "Northbound".
+// ID is what getstops and getpredictions expect as the dir parameter.
+type direction struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type stop struct {
+	StopID    string  `json:"stopId"`
+	StopName  string  `json:"stopName"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// pattern is the ordered geometry a vehicle's PatternID refers to. Length and
+// each point's Distance are in feet along the pattern, the same unit as a
+// vehicle's PatternDistance.
+type pattern struct {
+	PatternID string         `json:"patternId"`
+	Direction string         `json:"direction"`
+	Length    float64        `json:"length"`
+	Points    []patternPoint `json:"points"`
+}
+
+type patternPoint struct {
+	Sequence  int     `json:"sequence"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Distance  float64 `json:"distance"`
+	IsStop    bool    `json:"isStop"`
+	StopID    string  `json:"stopId,omitempty"`
+	StopName  string  `json:"stopName,omitempty"`
+}
+
+// SetCatalogStore enables persistent caching of directions and stops.
+// Entries older than ttl are refreshed from BusTime on the next lookup.
+func (s *CTAService) SetCatalogStore(store *CatalogStore, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultCatalogCacheTTL
+	}
+	s.catalog = store
+	s.catalogTTL = ttl
+}
+
+// catalogLookup decodes the cached entry for key into out. found reports
+// whether an entry exists at all, fresh whether it is younger than the TTL.
+func (s *CTAService) catalogLookup(key string, out interface{}) (found bool, fresh bool) {
+	if s.catalog == nil {
+		return false, false
+	}
+	fetchedAt, found, err := s.catalog.Get(key, out)
+	if err != nil {
+		s.logger.Error("failed to read catalog cache", "key", key, "error", err)
+		return false, false
+	}
+	return found, found && time.Since(fetchedAt) < s.catalogTTL
+}
+
+func (s *CTAService) catalogStore(key string, value interface{}) {
+	if s.catalog == nil {
+		return
+	}
+	if err := s.catalog.Put(key, value); err != nil {
+		s.logger.Error("failed to write catalog cache", "key", key, "error", err)
+	}
+}
+
+// cachedCatalog returns the entry for key from the catalog store if it is
+// still fresh, otherwise calls load and stores the result. If load fails and
+// a stale entry exists, the stale entry is returned instead.
+func cachedCatalog[T any](s *CTAService, key string, load func() (T, error)) (T, error) {
+	var cached T
+	found, fresh := s.catalogLookup(key, &cached)
+	if fresh {
+		s.logger.Info("serving catalog entry from cache", "key", key)
+		return cached, nil
+	}
+
+	loaded, err := load()
+	if err != nil {
+		if found {
+			s.logger.Warn("serving stale catalog entry after upstream failure", "key", key, "error", err)
+			return cached, nil
+		}
+		return loaded, err
+	}
+
+	s.catalogStore(key, loaded)
+	return loaded, nil
+}
+
+func (s *CTAService) GetDirections(ctx context.Context, routeID string) ([]direction, error) {
+	return cachedCatalog(s, catalogDirectionsPrefix+routeID, func() ([]direction, error) {
+		return s.fetchDirections(ctx, routeID)
+	})
+}
+
+func (s *CTAService) fetchDirections(ctx context.Context, routeID string) ([]direction, error) {
+	s.logger.Info("fetching directions from CTA API", "route", routeID)
+
+	params := url.Values{}
+	params.Set("rt", routeID)
+
+	var directionsResp ctaDirectionsResponse
+	if err := s.fetch(ctx, ctaGetDirections, params, &directionsResp); err != nil {
+		return nil, err
+	}
+
+	if len(directionsResp.BustimeResponse.Error) > 0 {
+		if isNoDataError(directionsResp.BustimeResponse.Error) {
+			return nil, newAPIError(http.StatusNotFound, fmt.Sprintf("no directions found for route %s", routeID), nil)
+		}
+		s.logger.Error("CTA API returned error", "errors", directionsResp.BustimeResponse.Error)
+		return nil, newAPIError(http.StatusBadGateway, "CTA API returned error", directionsResp.BustimeResponse)
+	}
+
+	directions := make([]direction, 0, len(directionsResp.BustimeResponse.Directions))
+	for _, d := range directionsResp.BustimeResponse.Directions {
+		name := string(d.Name)
+		if name == "" {
+			name = string(d.ID)
+		}
+		directions = append(directions, direction{ID: string(d.ID), Name: name})
+	}
+
+	s.logger.Info("successfully fetched directions", "route", routeID, "count", len(directions))
+	s.trackCall(ctaGetDirections)
+	return directions, nil
+}
+
+func (s *CTAService) GetStops(ctx context.Context, routeID string, dir string) ([]stop, error) {
+	key := catalogStopsPrefix + routeID + ":" + strings.ToLower(dir)
+	return cachedCatalog(s, key, func() ([]stop, error) {
+		return s.fetchStops(ctx, routeID, dir)
+	})
+}
+
+func (s *CTAService) fetchStops(ctx context.Context, routeID string, dir string) ([]stop, error) {
+	s.logger.Info("fetching stops from CTA API", "route", routeID, "direction", dir)
+
+	params := url.Values{}
+	params.Set("rt", routeID)
+	params.Set("dir", dir)
+
+	var stopsResp ctaStopsResponse
+	if err := s.fetch(ctx, ctaGetStops, params, &stopsResp); err != nil {
+		return nil, err
+	}
+
+	if len(stopsResp.BustimeResponse.Error) > 0 {
+		if isNoDataError(stopsResp.BustimeResponse.Error) {
+			return nil, newAPIError(http.StatusNotFound, fmt.Sprintf("no stops found for route %s direction %s", routeID, dir), nil)
+		}
+		s.logger.Error("CTA API returned error", "errors", stopsResp.BustimeResponse.Error)
+		return nil, newAPIError(http.StatusBadGateway, "CTA API returned error", stopsResp.BustimeResponse)
+	}
+
+	stops := make([]stop, 0, len(stopsResp.BustimeResponse.Stops))
+	for _, st := range stopsResp.BustimeResponse.Stops {
+		stops = append(stops, stop{
+			StopID:    string(st.Stpid),
+			StopName:  string(st.Stpnm),
+			Latitude:  float64(st.Lat),
+			Longitude: float64(st.Lon),
+		})
+	}
+
+	s.logger.Info("successfully fetched stops", "route", routeID, "direction", dir, "count", len(stops))
+	s.trackCall(ctaGetStops)
+	return stops, nil
+}
+
+func (s *CTAService) GetPattern(ctx context.Context, patternID string) (pattern, error) {
+	patterns, err := s.GetPatterns(ctx, []string{patternID})
+	if err != nil {
+		return pattern{}, err
+	}
+	if len(patterns) == 0 {
+		return pattern{}, newAPIError(http.StatusNotFound, fmt.Sprintf("pattern %s not found", patternID), nil)
+	}
+	return patterns[0], nil
+}
+
+// GetPatterns returns the requested patterns in the order given, skipping
+// IDs BusTime does not know. Cached patterns are served from the catalog
+// store and the rest are fetched in batches of 10.
+func (s *CTAService) GetPatterns(ctx context.Context, patternIDs []string) ([]pattern, error) {
+	patterns, _, err := s.getPatterns(ctx, patternIDs)
+	return patterns, err
+}
+
+// getPatterns is GetPatterns that also returns the IDs whose batch failed
+// but were served nothing, because other IDs in the batch had stale copies.
+// Those IDs are missing from the result without BusTime having said they
+// don't exist.
+func (s *CTAService) getPatterns(ctx context.Context, patternIDs []string) ([]pattern, []string, error) {
+	failed := make([]string, 0)
+	byID := make(map[string]pattern, len(patternIDs))
+	stale := make(map[string]pattern)
+	missing := make([]string, 0)
+	for _, pid := range patternIDs {
+		if _, seen := byID[pid]; seen {
+			continue
+		}
+		var cached pattern
+		found, fresh := s.catalogLookup(catalogPatternPrefix+pid, &cached)
+		switch {
+		case fresh:
+			byID[pid] = cached
+		case found:
+			stale[pid] = cached
+			missing = append(missing, pid)
+		default:
+			missing = append(missing, pid)
+		}
+	}
+
+	for _, batch := range batchIdentifiers(missing, maxBustimeIdentifiers) {
+		params := url.Values{}
+		params.Set("pid", strings.Join(batch, ","))
+		fetched, err := s.fetchPatterns(ctx, params)
+		if err != nil {
+			fallback := make([]pattern, 0, len(batch))
+			for _, pid := range batch {
+				if p, ok := stale[pid]; ok {
+					fallback = append(fallback, p)
+				}
+			}
+			if len(fallback) == 0 {
+				return nil, nil, err
+			}
+			s.logger.Warn("serving stale patterns after upstream failure", "patterns", batch, "error", err)
+			for _, p := range fallback {
+				byID[p.PatternID] = p
+			}
+			for _, pid := range batch {
+				if _, ok := stale[pid]; !ok {
+					failed = append(failed, pid)
+				}
+			}
+			continue
+		}
+		for _, p := range fetched {
+			byID[p.PatternID] = p
+			s.catalogStore(catalogPatternPrefix+p.PatternID, p)
+		}
+	}
+
+	patterns := make([]pattern, 0, len(byID))
+	added := make(map[string]bool, len(byID))
+	for _, pid := range patternIDs {
+		if p, ok := byID[pid]; ok && !added[pid] {
+			patterns = append(patterns, p)
+			added[pid] = true
+		}
+	}
+	return patterns, failed, nil
+}
+
+// GetRoutePatterns returns every pattern BusTime currently has for a route.
+func (s *CTAService) GetRoutePatterns(ctx context.Context, routeID string) ([]pattern, error) {
+	return cachedCatalog(s, catalogRoutePatternsPrefix+routeID, func() ([]pattern, error) {
+		params := url.Values{}
+		params.Set("rt", routeID)
+		patterns, err := s.fetchPatterns(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		if len(patterns) == 0 {
+			return nil, newAPIError(http.StatusNotFound, fmt.Sprintf("no patterns found for route %s", routeID), nil)
+		}
+		for _, p := range patterns {
+			s.catalogStore(catalogPatternPrefix+p.PatternID, p)
+		}
+		return patterns, nil
+	})
+}
+
+func (s *CTAService) fetchPatterns(ctx context.Context, params url.Values) ([]pattern, error) {
+	s.logger.Info("fetching patterns from CTA API", "params", params.Encode())
+
+	var patternsResp ctaPatternsResponse
+	if err := s.fetch(ctx, ctaGetPatterns, params, &patternsResp); err != nil {
+		return nil, err
+	}
+
+	if len(patternsResp.BustimeResponse.Patterns) == 0 && len(patternsResp.BustimeResponse.Error) > 0 {
+		if isNoDataError(patternsResp.BustimeResponse.Error) {
+			return []pattern{}, nil
+		}
+		s.logger.Error("CTA API returned error", "errors", patternsResp.BustimeResponse.Error)
+		return nil, newAPIError(http.StatusBadGateway, "CTA API returned error", patternsResp.BustimeResponse)
+	}
+
+	patterns := make([]pattern, 0, len(patternsResp.BustimeResponse.Patterns))
+	for _, p := range patternsResp.BustimeResponse.Patterns {
+		points := make([]patternPoint, 0, len(p.Pt))
+		for _, pt := range p.Pt {
+			points = append(points, patternPoint{
+				Sequence:  int(pt.Seq),
+				Latitude:  float64(pt.Lat),
+				Longitude: float64(pt.Lon),
+				Distance:  float64(pt.Pdist),
+				IsStop:    string(pt.Typ) == "S",
+				StopID:    string(pt.Stpid),
+				StopName:  string(pt.Stpnm),
+			})
+		}
+		sort.Slice(points, func(i, j int) bool { return points[i].Sequence < points[j].Sequence })
+
+		patterns = append(patterns, pattern{
+			PatternID: string(p.Pid),
+			Direction: string(p.Rtdir),
+			Length:    float64(p.Ln),
+			Points:    points,
+		})
+	}
+
+	s.logger.Info("successfully fetched patterns", "count", len(patterns))
+	s.trackCall(ctaGetPatterns)
+	return patterns, nil
+}
+
+// PatternDirections returns the BusTime direction name (e.g. "Northbound")
+// of each vehicle's pattern, keyed by pattern ID. Directions are remembered
+// for the life of the process, since a pattern ID never changes direction,
+// so only patterns not seen before cost a BusTime call. Patterns that can't
+// be looked up are left out and retried on the next call.
+func (s *CTAService) PatternDirections(ctx context.Context, vehicles []vehicle) map[string]string {
+	directions := make(map[string]string)
+	missing := make([]string, 0)
+
+	s.directionsMu.Lock()
+	for _, v := range vehicles {
+		if v.PatternID == "" {
+			continue
+		}
+		if _, seen := directions[v.PatternID]; seen {
+			continue
+		}
+		if dir, ok := s.patternDirections[v.PatternID]; ok {
+			directions[v.PatternID] = dir
+			continue
+		}
+		directions[v.PatternID] = ""
+		missing = append(missing, v.PatternID)
+	}
+	s.directionsMu.Unlock()
+
+	if len(missing) > 0 {
+		patterns, failed, err := s.getPatterns(ctx, missing)
+		if err != nil {
+			s.logger.Warn("failed to look up pattern directions", "patterns", len(missing), "error", err)
+		} else {
+			if len(failed) > 0 {
+				s.logger.Warn("failed to look up some pattern directions", "patterns", failed)
+			}
+			unresolved := make(map[string]bool, len(failed))
+			for _, pid := range failed {
+				unresolved[pid] = true
+			}
+
+			s.directionsMu.Lock()
+			for _, p := range patterns {
+				s.patternDirections[p.PatternID] = p.Direction
+			}
+			// Remember patterns BusTime doesn't know so they aren't requested
+			// again, but not ones whose lookup failed
+			for _, pid := range missing {
+				if unresolved[pid] {
+					continue
+				}
+				if _, ok := s.patternDirections[pid]; !ok {
+					s.patternDirections[pid] = ""
+				}
+				directions[pid] = s.patternDirections[pid]
+			}
+			s.directionsMu.Unlock()
+		}
+	}
+
+	for pid, dir := range directions {
+		if dir == "" {
+			delete(directions, pid)
+		}
+	}
+	return directions
+}
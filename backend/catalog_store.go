@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// CatalogStore persists slow-changing BusTime reference data (directions,
+// stops, ...) so repeat lookups do not count against the daily API quota.
+// Entries are stored as JSON keyed by a caller-chosen cache key.
+type CatalogStore struct {
+	db *sql.DB
+}
+
+func NewCatalogStore(dbPath string) (*CatalogStore, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	store := &CatalogStore{db: db}
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (c *CatalogStore) initSchema() error {
+	_, err := c.db.Exec(`
+		CREATE TABLE IF NOT EXISTS catalog_cache (
+			cache_key TEXT PRIMARY KEY,
+			payload TEXT NOT NULL,
+			fetched_at DATETIME NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS l_stations (
+			map_id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			descriptive_name TEXT NOT NULL,
+			lines TEXT NOT NULL,
+			ada INTEGER NOT NULL,
+			latitude REAL NOT NULL,
+			longitude REAL NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_l_stations_name ON l_stations(name);
+	`)
+	return err
+}
+
+func (c *CatalogStore) Close() error {
+	return c.db.Close()
+}
+
+// Get decodes the entry stored under key into out and returns when it was
+// fetched. found is false if there is no entry.
+func (c *CatalogStore) Get(key string, out interface{}) (fetchedAt time.Time, found bool, err error) {
+	var payload string
+	err = c.db.QueryRow(`SELECT payload, fetched_at FROM catalog_cache WHERE cache_key = ?`, key).Scan(&payload, &fetchedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if err := json.Unmarshal([]byte(payload), out); err != nil {
+		return time.Time{}, false, err
+	}
+	return fetchedAt, true, nil
+}
+
+// Put stores value under key, replacing any previous entry.
+func (c *CatalogStore) Put(key string, value interface{}) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`
+		INSERT INTO catalog_cache (cache_key, payload, fetched_at) VALUES (?, ?, ?)
+		ON CONFLICT(cache_key) DO UPDATE SET payload = excluded.payload, fetched_at = excluded.fetched_at
+	`, key, string(payload), time.Now().UTC())
+	return err
+}
+
+// station is an L station (the parent "map ID" stop) from the CTA list of
+// 'L' stops. Lines holds Train Tracker line codes such as "red" and "brn".
+type station struct {
+	MapID           string   `json:"mapId"`
+	Name            string   `json:"name"`
+	DescriptiveName string   `json:"descriptiveName"`
+	Lines           []string `json:"lines"`
+	Accessible      bool     `json:"accessible"`
+	Latitude        float64  `json:"latitude"`
+	Longitude       float64  `json:"longitude"`
+}
+
+// SearchStations returns stations whose name contains query, optionally
+// limited to those served by line. Both filters are optional.
+func (c *CatalogStore) SearchStations(query string, line string) ([]station, error) {
+	rows, err := c.db.Query(`
+		SELECT map_id, name, descriptive_name, lines, ada, latitude, longitude
+		FROM l_stations
+		WHERE (? = '' OR name LIKE '%' || ? || '%' OR descriptive_name LIKE '%' || ? || '%')
+			AND (? = '' OR (',' || lines || ',') LIKE '%,' || ? || ',%')
+		ORDER BY name, map_id
+	`, query, query, query, line, line)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]station, 0)
+	for rows.Next() {
+		st, err := scanStation(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, st)
+	}
+	return results, rows.Err()
+}
+
+// GetStation returns the station with the given map ID. found is false if
+// the station is not in the catalog.
+func (c *CatalogStore) GetStation(mapID string) (st station, found bool, err error) {
+	row := c.db.QueryRow(`
+		SELECT map_id, name, descriptive_name, lines, ada, latitude, longitude
+		FROM l_stations
+		WHERE map_id = ?
+	`, mapID)
+	st, err = scanStation(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return station{}, false, nil
+	}
+	return st, err == nil, err
+}
+
+func scanStation(row interface{ Scan(...interface{}) error }) (station, error) {
+	var st station
+	var lines string
+	if err := row.Scan(&st.MapID, &st.Name, &st.DescriptiveName, &lines, &st.Accessible, &st.Latitude, &st.Longitude); err != nil {
+		return station{}, err
+	}
+	st.Lines = make([]string, 0)
+	for _, l := range strings.Split(lines, ",") {
+		if l != "" {
+			st.Lines = append(st.Lines, l)
+		}
+	}
+	return st, nil
+}
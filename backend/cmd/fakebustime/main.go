@@ -0,0 +1,42 @@
+// Command fakebustime serves scripted BusTime v3 responses for local development.
+//
+//	go run ./cmd/fakebustime -addr :9090 -scenario path/to/scenario.json
+//
+// Point the backend at it with CTA_API_BASE_URL=http://localhost:9090/bustime/api/v3.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"cta-map/backend/fakebustime"
+)
+
+func main() {
+	addr := flag.String("addr", ":9090", "address to listen on")
+	scenarioPath := flag.String("scenario", "", "scenario JSON file (defaults to the bundled scenario)")
+	latency := flag.Duration("latency", 0, "delay added to every response, e.g. 300ms")
+	failRate := flag.Float64("fail-rate", 0, "fraction of requests to fail, e.g. 0.2")
+	failStatus := flag.Int("fail-status", 503, "HTTP status for failed requests")
+	failDrop := flag.Bool("fail-drop", false, "fail requests by closing the connection instead")
+	flag.Parse()
+
+	scenario := fakebustime.DefaultScenario()
+	if *scenarioPath != "" {
+		loaded, err := fakebustime.LoadScenario(*scenarioPath)
+		if err != nil {
+			log.Fatalf("Failed to load scenario: %v", err)
+		}
+		scenario = loaded
+	}
+
+	server := fakebustime.NewServer(scenario)
+	server.SetLatency(*latency)
+	if *failRate > 0 {
+		server.SetFault(&fakebustime.Fault{Status: *failStatus, Drop: *failDrop, Rate: *failRate})
+	}
+
+	log.Printf("fake BusTime server listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
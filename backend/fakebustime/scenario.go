@@ -0,0 +1,65 @@
+package fakebustime
+
+import (
+	_ "embed"
+	"encoding/json"
+	"os"
+)
+
+//go:embed default_scenario.json
+var defaultScenario []byte
+
+// Route mirrors a BusTime getroutes entry.
+type Route struct {
+	Rt    string `json:"rt"`
+	Rtnm  string `json:"rtnm"`
+	Rtclr string `json:"rtclr"`
+	Rtdd  string `json:"rtdd"`
+}
+
+// Scenario is the scripted data a Server answers with. Vehicles are kept as
+// raw BusTime JSON so a scenario can mix string and numeric field encodings
+// exactly as the real API does.
+type Scenario struct {
+	Routes []Route `json:"routes"`
+	// Vehicles maps a route designator to the vehicles reported for it.
+	Vehicles map[string][]json.RawMessage `json:"vehicles"`
+	// Directions maps a route designator to its getdirections entries.
+	Directions map[string][]json.RawMessage `json:"directions,omitempty"`
+	// Stops maps a route designator and then a direction to its getstops entries.
+	Stops map[string]map[string][]json.RawMessage `json:"stops,omitempty"`
+	// Patterns maps a route designator to its getpatterns entries.
+	Patterns map[string][]json.RawMessage `json:"patterns,omitempty"`
+	// Bulletins are getservicebulletins entries, matched to routes through their "srvc" list.
+	Bulletins []json.RawMessage `json:"bulletins,omitempty"`
+	// Detours are getdetours entries.
+	Detours []json.RawMessage `json:"detours,omitempty"`
+	// Predictions maps a stop ID to the predictions reported for it.
+	Predictions map[string][]json.RawMessage `json:"predictions,omitempty"`
+	// Errors forces an endpoint (e.g. "getroutes") to answer with a BusTime error message.
+	Errors map[string]string `json:"errors,omitempty"`
+	// RouteErrors fails any getvehicles request that includes one of these
+	// routes with the given message, simulating a hiccup on a single batch.
+	RouteErrors map[string]string `json:"routeErrors,omitempty"`
+}
+
+// DefaultScenario returns the scenario bundled with the package: a handful of
+// routes, some with active buses and some without.
+func DefaultScenario() Scenario {
+	var scenario Scenario
+	if err := json.Unmarshal(defaultScenario, &scenario); err != nil {
+		panic("fakebustime: invalid default scenario: " + err.Error())
+	}
+	return scenario
+}
+
+// LoadScenario reads a scenario from a JSON file.
+func LoadScenario(path string) (Scenario, error) {
+	var scenario Scenario
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return scenario, err
+	}
+	err = json.Unmarshal(data, &scenario)
+	return scenario, err
+}
@@ -0,0 +1,352 @@
+// Package fakebustime implements a stand-in for the CTA BusTime v3 API so the
+// backend can be developed, demoed and tested without a real API key.
+package fakebustime
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	noDataMessage   = "No data found for parameter"
+	noArrivalsError = "No arrival times"
+	maxIdentifiers  = 10
+	missingKeyError = "No API access key supplied"
+)
+
+type bustimeError struct {
+	Rt  string `json:"rt,omitempty"`
+	Msg string `json:"msg"`
+}
+
+// Server answers BusTime requests from a Scenario. The endpoint is taken from
+// the last path segment, so it can be mounted under any base URL.
+type Server struct {
+	mu       sync.RWMutex
+	scenario Scenario
+	calls    map[string]int
+	latency  time.Duration
+	fault    *Fault
+
+	inFlight     int
+	peakInFlight int
+}
+
+// Fault makes the server fail requests before they reach the scenario, to
+// exercise the backend's retries and circuit breaker.
+type Fault struct {
+	// Status is the HTTP status to fail with; ignored when Drop is set.
+	Status int
+	// Drop closes the connection without writing a response.
+	Drop bool
+	// Count is how many requests to fail before the fault clears itself;
+	// 0 fails every request until SetFault(nil).
+	Count int
+	// Rate, when set, fails each request with this probability instead of
+	// every one.
+	Rate float64
+}
+
+func NewServer(scenario Scenario) *Server {
+	return &Server{scenario: scenario, calls: make(map[string]int)}
+}
+
+// SetScenario replaces the scripted data, e.g. to advance a test to its next step.
+func (s *Server) SetScenario(scenario Scenario) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scenario = scenario
+}
+
+// SetLatency delays every response by d, to approximate the real API's round trip.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// SetFault injects a fault into subsequent requests; nil clears it.
+func (s *Server) SetFault(fault *Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fault != nil {
+		copied := *fault
+		fault = &copied
+	}
+	s.fault = fault
+}
+
+// Calls returns how many requests have been served for an endpoint such as "getvehicles".
+func (s *Server) Calls(endpoint string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.calls[endpoint]
+}
+
+// PeakInFlight returns the most requests the server has been handling at once.
+func (s *Server) PeakInFlight() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.peakInFlight
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	endpoint := path.Base(r.URL.Path)
+
+	s.mu.Lock()
+	s.calls[endpoint]++
+	s.inFlight++
+	if s.inFlight > s.peakInFlight {
+		s.peakInFlight = s.inFlight
+	}
+	scenario := s.scenario
+	latency := s.latency
+	fault := s.takeFault()
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+
+	if fault != nil {
+		if fault.Drop {
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		}
+		status := fault.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	if query.Get("key") == "" {
+		writeResponse(w, map[string]interface{}{"error": []bustimeError{{Msg: missingKeyError}}})
+		return
+	}
+	if msg, ok := scenario.Errors[endpoint]; ok {
+		writeResponse(w, map[string]interface{}{"error": []bustimeError{{Msg: msg}}})
+		return
+	}
+
+	switch endpoint {
+	case "getroutes":
+		writeResponse(w, map[string]interface{}{"routes": scenario.Routes})
+	case "getvehicles":
+		writeResponse(w, scenario.vehicles(splitIdentifiers(query.Get("rt"))))
+	case "getdirections":
+		writeResponse(w, listOrNoData("directions", scenario.Directions[query.Get("rt")]))
+	case "getstops":
+		writeResponse(w, listOrNoData("stops", scenario.Stops[query.Get("rt")][query.Get("dir")]))
+	case "getpatterns":
+		writeResponse(w, scenario.patterns(query.Get("rt"), splitIdentifiers(query.Get("pid"))))
+	case "getservicebulletins":
+		writeResponse(w, scenario.bulletins(splitIdentifiers(query.Get("rt"))))
+	case "getdetours":
+		writeResponse(w, listOrNoData("dtrs", scenario.Detours))
+	case "getpredictions":
+		writeResponse(w, scenario.predictions(splitIdentifiers(query.Get("stpid")), splitIdentifiers(query.Get("vid"))))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// vehicles builds a getvehicles payload. Like the real API, routes without
+// active buses produce a "No data found" error alongside any vehicles found.
+func (sc Scenario) vehicles(routes []string) map[string]interface{} {
+	if len(routes) == 0 {
+		return map[string]interface{}{"error": []bustimeError{{Msg: "No route or vehicle parameter provided"}}}
+	}
+	if len(routes) > maxIdentifiers {
+		return map[string]interface{}{"error": []bustimeError{{Msg: "Maximum number of identifiers exceeded"}}}
+	}
+
+	for _, rt := range routes {
+		if msg, ok := sc.RouteErrors[rt]; ok {
+			return map[string]interface{}{"error": []bustimeError{{Rt: rt, Msg: msg}}}
+		}
+	}
+
+	vehicles := make([]json.RawMessage, 0)
+	errs := make([]bustimeError, 0)
+	for _, rt := range routes {
+		found := sc.Vehicles[rt]
+		if len(found) == 0 {
+			errs = append(errs, bustimeError{Rt: rt, Msg: noDataMessage})
+			continue
+		}
+		vehicles = append(vehicles, found...)
+	}
+
+	payload := make(map[string]interface{})
+	if len(vehicles) > 0 {
+		payload["vehicle"] = vehicles
+	}
+	if len(errs) > 0 {
+		payload["error"] = errs
+	}
+	return payload
+}
+
+// patterns builds a getpatterns payload for a route or a list of pattern IDs.
+func (sc Scenario) patterns(route string, patternIDs []string) map[string]interface{} {
+	if route != "" {
+		return listOrNoData("ptr", sc.Patterns[route])
+	}
+	if len(patternIDs) > maxIdentifiers {
+		return map[string]interface{}{"error": []bustimeError{{Msg: "Maximum number of identifiers exceeded"}}}
+	}
+
+	wanted := make(map[string]bool, len(patternIDs))
+	for _, pid := range patternIDs {
+		wanted[pid] = true
+	}
+	patterns := make([]json.RawMessage, 0)
+	for _, ptrs := range sc.Patterns {
+		for _, ptr := range ptrs {
+			if wanted[rawField(ptr, "pid")] {
+				patterns = append(patterns, ptr)
+			}
+		}
+	}
+	return listOrNoData("ptr", patterns)
+}
+
+// bulletins builds a getservicebulletins payload for the requested routes.
+func (sc Scenario) bulletins(routes []string) map[string]interface{} {
+	wanted := make(map[string]bool, len(routes))
+	for _, rt := range routes {
+		wanted[rt] = true
+	}
+
+	bulletins := make([]json.RawMessage, 0)
+	for _, sb := range sc.Bulletins {
+		var affected struct {
+			Srvc []struct {
+				Rt string `json:"rt"`
+			} `json:"srvc"`
+		}
+		if err := json.Unmarshal(sb, &affected); err != nil {
+			continue
+		}
+		for _, svc := range affected.Srvc {
+			if wanted[svc.Rt] {
+				bulletins = append(bulletins, sb)
+				break
+			}
+		}
+	}
+	return listOrNoData("sb", bulletins)
+}
+
+// predictions builds a getpredictions payload for either stop IDs or vehicle IDs.
+func (sc Scenario) predictions(stopIDs []string, vehicleIDs []string) map[string]interface{} {
+	if (len(stopIDs) == 0) == (len(vehicleIDs) == 0) {
+		return map[string]interface{}{"error": []bustimeError{{Msg: "Either stpid or vid parameter must be provided"}}}
+	}
+	if len(stopIDs) > maxIdentifiers || len(vehicleIDs) > maxIdentifiers {
+		return map[string]interface{}{"error": []bustimeError{{Msg: "Maximum number of identifiers exceeded"}}}
+	}
+
+	predictions := make([]json.RawMessage, 0)
+	if len(stopIDs) > 0 {
+		for _, stpid := range stopIDs {
+			predictions = append(predictions, sc.Predictions[stpid]...)
+		}
+	} else {
+		wanted := make(map[string]bool, len(vehicleIDs))
+		for _, vid := range vehicleIDs {
+			wanted[vid] = true
+		}
+		for _, prds := range sc.Predictions {
+			for _, prd := range prds {
+				if wanted[rawField(prd, "vid")] {
+					predictions = append(predictions, prd)
+				}
+			}
+		}
+	}
+
+	if len(predictions) == 0 {
+		return map[string]interface{}{"error": []bustimeError{{Msg: noArrivalsError}}}
+	}
+	return map[string]interface{}{"prd": predictions}
+}
+
+// takeFault returns the fault to apply to this request, if any, counting it
+// down. s.mu must be held.
+func (s *Server) takeFault() *Fault {
+	if s.fault == nil {
+		return nil
+	}
+	fault := s.fault
+	if fault.Rate > 0 && rand.Float64() >= fault.Rate {
+		return nil
+	}
+	if fault.Count > 0 {
+		fault.Count--
+		if fault.Count == 0 {
+			s.fault = nil
+		}
+	}
+	return fault
+}
+
+// listOrNoData wraps entries under field, or answers "No data found" when there are none.
+func listOrNoData(field string, entries []json.RawMessage) map[string]interface{} {
+	if len(entries) == 0 {
+		return map[string]interface{}{"error": []bustimeError{{Msg: noDataMessage}}}
+	}
+	return map[string]interface{}{field: entries}
+}
+
+// rawField returns a top-level field of a raw BusTime object as a string,
+// whether it was encoded as a JSON string or a number.
+func rawField(raw json.RawMessage, field string) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return ""
+	}
+	return strings.Trim(string(fields[field]), `"`)
+}
+
+func splitIdentifiers(param string) []string {
+	ids := make([]string, 0)
+	for _, id := range strings.Split(param, ",") {
+		if trimmed := strings.TrimSpace(id); trimmed != "" {
+			ids = append(ids, trimmed)
+		}
+	}
+	return ids
+}
+
+func writeResponse(w http.ResponseWriter, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"bustime-response": payload})
+}
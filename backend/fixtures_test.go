@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Fixtures are BusTime exchanges in the captureEntry format, one directory per
+// test under testdata/fixtures. To re-record them against the live API (the
+// tests assert on the recorded data, so expect to update them):
+//
+//	CTA_API_KEY=... go test -run TestGetRoutes -record
+var recordFixtures = flag.Bool("record", false, "record BusTime fixtures from "+baseURLEnv+" (needs "+apiKeyEnv+")")
+
+const fixtureBaseURL = "https://fixtures.invalid/bustime/api/v3"
+
+// newFixtureService returns a CTAService whose BusTime requests are answered
+// from the test's fixture directory, or recorded into it with -record.
+func newFixtureService(t *testing.T) *CTAService {
+	t.Helper()
+	dir := filepath.Join("testdata", "fixtures", filepath.FromSlash(t.Name()))
+
+	apiKey, baseURL := "fixture-key", fixtureBaseURL
+	var transport http.RoundTripper
+	if *recordFixtures {
+		apiKey, baseURL = os.Getenv(apiKeyEnv), os.Getenv(baseURLEnv)
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		capture, err := newCaptureTransport(dir, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport = capture
+	} else {
+		transport = loadFixtures(t, dir)
+	}
+
+	return newTransportService(t, apiKey, baseURL, transport)
+}
+
+// newTransportService returns a CTAService without caching or retries that
+// sends its BusTime requests through transport.
+func newTransportService(t *testing.T, apiKey string, baseURL string, transport http.RoundTripper) *CTAService {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	service, err := NewCTAService(apiKey, baseURL, &http.Client{Transport: transport}, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.SetRouteCacheTTL(0, 0)
+	service.SetRetryPolicy(retryPolicy{Attempts: 1})
+	return service
+}
+
+// fixtureTransport answers requests with the recorded response for the same
+// endpoint and query. Requests that were recorded more than once get the
+// recordings in order, repeating the last; unrecorded requests fail the test.
+type fixtureTransport struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	entries map[string][]captureEntry
+}
+
+func loadFixtures(t *testing.T, dir string) *fixtureTransport {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no fixtures in %s (record them with -record)", dir)
+	}
+	sort.Strings(files)
+
+	transport := &fixtureTransport{t: t, entries: make(map[string][]captureEntry)}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry captureEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		key := entry.Endpoint + "?" + entry.Query
+		transport.entries[key] = append(transport.entries[key], entry)
+	}
+	return transport
+}
+
+func (f *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("key") == "" {
+		f.t.Errorf("request to %s sent without an API key", req.URL.Path)
+	}
+	key := path.Base(req.URL.Path) + "?" + captureQuery(req.URL.Query())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries := f.entries[key]
+	if len(entries) == 0 {
+		f.t.Errorf("no fixture for %s", key)
+		return nil, fmt.Errorf("no fixture for %s", key)
+	}
+	entry := entries[0]
+	if len(entries) > 1 {
+		f.entries[key] = entries[1:]
+	}
+	return replayResponse(req, entry.Status, entry.body()), nil
+}
+
+func TestCaptureTransportScrubsAPIKey(t *testing.T) {
+	const secret = "s3cr3t-api-key"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"bustime-response":{"error":[{"msg":"Invalid API access key supplied: %s"}]}}`, r.URL.Query().Get("key"))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	capture, err := newCaptureTransport(dir, upstream.Client().Transport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording := newTransportService(t, secret, upstream.URL, capture)
+	if _, err := recording.GetRoutes(context.Background()); err == nil {
+		t.Fatal("expected the BusTime error")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 capture, got %d", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Fatalf("capture contains the API key:\n%s", data)
+	}
+
+	// The capture replays without the key
+	replayed := newTransportService(t, "fixture-key", fixtureBaseURL, loadFixtures(t, dir))
+	if _, err := replayed.GetRoutes(context.Background()); err == nil || !strings.Contains(err.Error(), "CTA API returned error") {
+		t.Fatalf("expected the replayed BusTime error, got %v", err)
+	}
+}
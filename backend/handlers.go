@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -12,19 +13,81 @@ import (
 const maxRouteParams = 10
 
 type Handlers struct {
-	ctaService *CTAService
-	logger     *slog.Logger
+	ctaService    *CTAService
+	poller        *VehiclePoller
+	logger        *slog.Logger
+	socketOrigins []string
 }
 
-func NewHandlers(ctaService *CTAService, logger *slog.Logger) *Handlers {
+// NewHandlers creates the CTA handlers. poller is optional; when set, vehicle
+// and stats endpoints are served from its snapshot instead of calling CTA.
+func NewHandlers(ctaService *CTAService, poller *VehiclePoller, logger *slog.Logger) *Handlers {
 	if logger == nil {
 		logger = slog.Default()
 	}
-	return &Handlers{ctaService: ctaService, logger: logger}
+	return &Handlers{ctaService: ctaService, poller: poller, logger: logger}
 }
 
-func (h *Handlers) Health(c echo.Context) error {
-	return c.String(http.StatusOK, "CTA backend is running")
+// SetSocketOrigins sets the cross-origin pages allowed to open the vehicle
+// WebSocket. "*" is ignored: pages served by the backend itself are always
+// allowed, and other origins have to be listed.
+func (h *Handlers) SetSocketOrigins(origins []string) {
+	h.socketOrigins = origins
+}
+
+// snapshot returns the poller's latest snapshot and sets Last-Modified/Age
+// headers from it. ok is false when polling is disabled, and callers then go
+// to CTA themselves. With polling enabled requests never reach CTA: until the
+// first poll succeeds err is a 503 with Retry-After, and after that the last
+// good snapshot is served however old it gets. The vehicles' data ages
+// include the snapshot's own age.
+func (h *Handlers) snapshot(c echo.Context) (vehicleSnapshot, bool, error) {
+	if h.poller == nil {
+		return vehicleSnapshot{}, false, nil
+	}
+	snap, ok := h.poller.Snapshot()
+	if !ok {
+		err := newAPIError(http.StatusServiceUnavailable, "vehicle data is not available yet; the first poll hasn't completed", nil)
+		err.retryAfter = h.poller.interval
+		return vehicleSnapshot{}, false, err
+	}
+	c.Response().Header().Set(echo.HeaderLastModified, snap.FetchedAt.UTC().Format(http.TimeFormat))
+	c.Response().Header().Set("Age", strconv.Itoa(int(snap.Age().Seconds())))
+	return snap.aged(), true, nil
+}
+
+// HealthHandlers reports whether the backend is up and the state of each
+// upstream circuit breaker.
+type HealthHandlers struct {
+	ctaService   *CTAService
+	trainService *TrainService
+}
+
+// NewHealthHandlers creates the health handler. trainService is optional.
+func NewHealthHandlers(ctaService *CTAService, trainService *TrainService) *HealthHandlers {
+	return &HealthHandlers{ctaService: ctaService, trainService: trainService}
+}
+
+type HealthResponse struct {
+	Status    string                   `json:"status"`
+	Upstreams map[string]breakerStatus `json:"upstreams"`
+}
+
+// Health handles GET /. Status is "degraded" while any breaker is not closed.
+func (h *HealthHandlers) Health(c echo.Context) error {
+	response := HealthResponse{
+		Status:    "ok",
+		Upstreams: map[string]breakerStatus{trackedAPIBusTime: h.ctaService.BreakerStatus()},
+	}
+	if h.trainService != nil {
+		response.Upstreams[trackedAPITrainTracker] = h.trainService.BreakerStatus()
+	}
+	for _, status := range response.Upstreams {
+		if status.State != breakerClosed {
+			response.Status = "degraded"
+		}
+	}
+	return c.JSON(http.StatusOK, response)
 }
 
 // ConfigHandlers handles configuration endpoints
@@ -49,10 +112,27 @@ func (h *ConfigHandlers) GetConfig(c echo.Context) error {
 	return c.JSON(http.StatusOK, config)
 }
 
+// GetRoutes handles GET /api/routes, or /api/routes?bulletins=true to flag
+// routes with active service bulletins.
 func (h *Handlers) GetRoutes(c echo.Context) error {
 	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path())
 
-	routes, err := h.ctaService.GetRoutes(c.Request().Context())
+	withBulletins := false
+	if raw := c.QueryParam("bulletins"); raw != "" {
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid bulletins parameter (must be true or false)")
+		}
+		withBulletins = parsed
+	}
+
+	var routes []route
+	var err error
+	if withBulletins {
+		routes, err = h.ctaService.GetRoutesWithBulletins(c.Request().Context())
+	} else {
+		routes, err = h.ctaService.GetRoutes(c.Request().Context())
+	}
 	if err != nil {
 		return writeError(c, err)
 	}
@@ -60,28 +140,213 @@ func (h *Handlers) GetRoutes(c echo.Context) error {
 	return c.JSON(http.StatusOK, routes)
 }
 
+// GetAllVehicleLocations handles GET /api/vehicles/all. With ?partial=true the
+// response is a {vehicles, errors, partial} envelope, and a 207 Multi-Status
+// signals that some route batches failed. ?stale=false hides stale vehicles.
 func (h *Handlers) GetAllVehicleLocations(c echo.Context) error {
 	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path())
 
-	vehicles, err := h.ctaService.GetAllVehicles(c.Request().Context())
+	hideStale, err := parseHideStale(c)
+	if err != nil {
+		return err
+	}
+
+	partial := false
+	if raw := c.QueryParam("partial"); raw != "" {
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid partial parameter (must be true or false)")
+		}
+		partial = parsed
+	}
+
+	if partial {
+		result, err := h.allVehiclesPartial(c)
+		if err != nil {
+			return writeError(c, err)
+		}
+		if hideStale {
+			result.Vehicles = withoutStale(result.Vehicles, h.ctaService.StaleAfter())
+		}
+		status := http.StatusOK
+		if result.Partial {
+			status = http.StatusMultiStatus
+		}
+		return c.JSON(status, result)
+	}
+
+	vehicles, err := h.allVehicles(c)
 	if err != nil {
 		return writeError(c, err)
 	}
+	if hideStale {
+		vehicles = withoutStale(vehicles, h.ctaService.StaleAfter())
+	}
 
 	return c.JSON(http.StatusOK, vehicles)
 }
 
+// allVehicles returns every vehicle, from the poller snapshot when there is
+// one and from CTA otherwise.
+func (h *Handlers) allVehicles(c echo.Context) ([]vehicle, error) {
+	if snap, ok, err := h.snapshot(c); ok || err != nil {
+		return snap.Vehicles, err
+	}
+	return h.ctaService.GetAllVehicles(c.Request().Context())
+}
+
+// parseHideStale reads ?stale=false, which hides vehicles whose data is at
+// least VEHICLE_STALE_AFTER old, counting the time a polled snapshot has been
+// served for.
+func parseHideStale(c echo.Context) (bool, error) {
+	raw := c.QueryParam("stale")
+	if raw == "" {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusBadRequest, "invalid stale parameter (must be true or false)")
+	}
+	return !include, nil
+}
+
+// allVehiclesPartial returns every vehicle plus the batches that failed, from
+// the poller snapshot when there is one and from CTA otherwise.
+func (h *Handlers) allVehiclesPartial(c echo.Context) (vehiclesResult, error) {
+	snap, ok, err := h.snapshot(c)
+	if err != nil {
+		return vehiclesResult{}, err
+	}
+	if ok {
+		fetchedAt := snap.FetchedAt
+		age := int(snap.Age().Seconds())
+		return vehiclesResult{
+			Vehicles:   snap.Vehicles,
+			Errors:     snap.Errors,
+			Partial:    len(snap.Errors) > 0,
+			FetchedAt:  &fetchedAt,
+			AgeSeconds: &age,
+		}, nil
+	}
+	return h.ctaService.GetAllVehiclesPartial(c.Request().Context())
+}
+
+// GetAllVehicleLocationsV2 handles GET /api/v2/vehicles/all. It always returns
+// the {vehicles, invalid, errors, partial} envelope of typed vehicles, with a
+// 207 Multi-Status when some route batches failed.
+func (h *Handlers) GetAllVehicleLocationsV2(c echo.Context) error {
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path())
+
+	hideStale, err := parseHideStale(c)
+	if err != nil {
+		return err
+	}
+
+	result, err := h.allVehiclesPartial(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+	if hideStale {
+		result.Vehicles = withoutStale(result.Vehicles, h.ctaService.StaleAfter())
+	}
+
+	vehicles, invalid := toVehiclesV2(result.Vehicles)
+	if len(invalid) > 0 {
+		h.logger.Warn("dropped invalid vehicle rows", "invalid", len(invalid))
+	}
+	status := http.StatusOK
+	if result.Partial {
+		status = http.StatusMultiStatus
+	}
+	return c.JSON(status, vehiclesV2Result{
+		Vehicles:   vehicles,
+		Invalid:    invalid,
+		Errors:     result.Errors,
+		Partial:    result.Partial,
+		FetchedAt:  result.FetchedAt,
+		AgeSeconds: result.AgeSeconds,
+	})
+}
+
+// GetRouteStats handles GET /api/routes/stats, from the poller snapshot when
+// there is one and from CTA otherwise.
 func (h *Handlers) GetRouteStats(c echo.Context) error {
 	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path())
 
-	stats, err := h.ctaService.GetRouteStats(c.Request().Context())
+	snap, ok, err := h.snapshot(c)
 	if err != nil {
 		return writeError(c, err)
 	}
+	if !ok {
+		// Without polling, fetch the vehicles the same way /api/vehicles/all does
+		ctx := c.Request().Context()
+		if snap.Routes, err = h.ctaService.GetRoutes(ctx); err != nil {
+			return writeError(c, err)
+		}
+		if snap.Vehicles, err = h.ctaService.GetAllVehicles(ctx); err != nil {
+			return writeError(c, err)
+		}
+		snap.Directions = h.ctaService.PatternDirections(ctx, snap.Vehicles)
+	}
 
+	stats := buildRouteStats(snap.Routes, snap.Vehicles, snap.Directions, h.ctaService.BunchingThreshold())
+	h.logger.Info("calculated route stats", "routes", len(stats), "totalVehicles", len(snap.Vehicles))
 	return c.JSON(http.StatusOK, stats)
 }
 
+// GetRouteBunching handles GET /api/routes/:route/bunching?threshold=1320,
+// listing buses on the same pattern closer together than threshold feet
+// (BUNCHING_THRESHOLD_FEET by default).
+func (h *Handlers) GetRouteBunching(c echo.Context) error {
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path())
+
+	routeID := strings.TrimSpace(c.Param("route"))
+	if routeID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "route parameter is required")
+	}
+
+	threshold := h.ctaService.BunchingThreshold()
+	if raw := strings.TrimSpace(c.QueryParam("threshold")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid threshold parameter (must be a positive number of feet)")
+		}
+		threshold = parsed
+	}
+
+	vehicles, err := h.routeVehicles(c, []string{routeID})
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	bunches := detectBunching(vehicles, threshold)
+	return c.JSON(http.StatusOK, routeBunching{
+		Route:           routeID,
+		ThresholdFeet:   threshold,
+		Bunches:         bunches,
+		BunchedVehicles: countBunchedVehicles(bunches),
+	})
+}
+
+// GetRouteHeadways handles GET /api/routes/:route/headways, the gaps between
+// consecutive buses on each of the route's patterns in feet and estimated
+// seconds, with their average, largest and coefficient of variation.
+func (h *Handlers) GetRouteHeadways(c echo.Context) error {
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path())
+
+	routeID := strings.TrimSpace(c.Param("route"))
+	if routeID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "route parameter is required")
+	}
+
+	vehicles, err := h.routeVehicles(c, []string{routeID})
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, buildRouteHeadways(routeID, vehicles, h.ctaService.RecentSpeed))
+}
+
 func (h *Handlers) GetVehicleLocations(c echo.Context) error {
 	routeParam := strings.TrimSpace(c.QueryParam("rt"))
 
@@ -91,15 +356,73 @@ func (h *Handlers) GetVehicleLocations(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "query parameter 'rt' is required (comma-separated route designators)")
 	}
 
-	routeIDs := make([]string, 0)
-	for _, r := range strings.Split(routeParam, ",") {
-		trimmed := strings.TrimSpace(r)
-		if trimmed == "" {
-			continue
-		}
-		routeIDs = append(routeIDs, trimmed)
+	routeIDs := splitIdentifiers(routeParam)
+	if len(routeIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "query parameter 'rt' is required (comma-separated route designators)")
+	}
+	if len(routeIDs) > maxRouteParams {
+		return echo.NewHTTPError(http.StatusBadRequest, "a maximum of 10 routes can be requested at once")
+	}
+	hideStale, err := parseHideStale(c)
+	if err != nil {
+		return err
+	}
+
+	vehicles, err := h.routeVehicles(c, routeIDs)
+	if err != nil {
+		return writeError(c, err)
+	}
+	if hideStale {
+		vehicles = withoutStale(vehicles, h.ctaService.StaleAfter())
+	}
+
+	return c.JSON(http.StatusOK, vehicles)
+}
+
+// GetVehicleAnomalies handles GET /api/vehicles/anomalies?rt=9,22, listing
+// stale, idle and position-jumping vehicles on the given routes, or on every
+// route when rt is omitted.
+func (h *Handlers) GetVehicleAnomalies(c echo.Context) error {
+	routeParam := strings.TrimSpace(c.QueryParam("rt"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "routes", routeParam)
+
+	routeIDs := splitIdentifiers(routeParam)
+	if len(routeIDs) > maxRouteParams {
+		return echo.NewHTTPError(http.StatusBadRequest, "a maximum of 10 routes can be requested at once")
+	}
+
+	var vehicles []vehicle
+	var err error
+	if len(routeIDs) > 0 {
+		vehicles, err = h.routeVehicles(c, routeIDs)
+	} else {
+		vehicles, err = h.allVehicles(c)
 	}
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, findAnomalies(vehicles, h.ctaService.StaleAfter(), h.ctaService.IdleAfter(), h.ctaService.RecentJump))
+}
+
+// routeVehicles returns the vehicles on the given routes, from the poller
+// snapshot when there is one and from CTA otherwise.
+func (h *Handlers) routeVehicles(c echo.Context, routeIDs []string) ([]vehicle, error) {
+	if snap, ok, err := h.snapshot(c); ok || err != nil {
+		return filterVehiclesByRoute(snap.Vehicles, routeIDs), err
+	}
+	return h.ctaService.GetVehicles(c.Request().Context(), routeIDs)
+}
+
+// GetVehicleLocationsV2 handles GET /api/v2/vehicles/locations?rt=9,22 and
+// returns typed vehicles plus validation errors for rows that were dropped.
+func (h *Handlers) GetVehicleLocationsV2(c echo.Context) error {
+	routeParam := strings.TrimSpace(c.QueryParam("rt"))
 
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "routes", routeParam)
+
+	routeIDs := splitIdentifiers(routeParam)
 	if len(routeIDs) == 0 {
 		return echo.NewHTTPError(http.StatusBadRequest, "query parameter 'rt' is required (comma-separated route designators)")
 	}
@@ -107,16 +430,195 @@ func (h *Handlers) GetVehicleLocations(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "a maximum of 10 routes can be requested at once")
 	}
 
-	vehicles, err := h.ctaService.GetVehicles(c.Request().Context(), routeIDs)
+	hideStale, err := parseHideStale(c)
+	if err != nil {
+		return err
+	}
+
+	raw, err := h.routeVehicles(c, routeIDs)
 	if err != nil {
 		return writeError(c, err)
 	}
+	if hideStale {
+		raw = withoutStale(raw, h.ctaService.StaleAfter())
+	}
 
-	return c.JSON(http.StatusOK, vehicles)
+	vehicles, invalid := toVehiclesV2(raw)
+	if len(invalid) > 0 {
+		h.logger.Warn("dropped invalid vehicle rows", "routes", routeIDs, "invalid", len(invalid))
+	}
+	return c.JSON(http.StatusOK, vehiclesV2Result{
+		Vehicles: vehicles,
+		Invalid:  invalid,
+		Errors:   []batchError{},
+	})
+}
+
+// GetPredictions handles GET /api/predictions?stpid=1,2 or /api/predictions?vid=1,2
+func (h *Handlers) GetPredictions(c echo.Context) error {
+	stopParam := strings.TrimSpace(c.QueryParam("stpid"))
+	vehicleParam := strings.TrimSpace(c.QueryParam("vid"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "stops", stopParam, "vehicles", vehicleParam)
+
+	stopIDs := splitIdentifiers(stopParam)
+	vehicleIDs := splitIdentifiers(vehicleParam)
+	if (len(stopIDs) == 0) == (len(vehicleIDs) == 0) {
+		return echo.NewHTTPError(http.StatusBadRequest, "exactly one of query parameters 'stpid' or 'vid' is required (comma-separated IDs)")
+	}
+	if len(stopIDs) > maxRouteParams || len(vehicleIDs) > maxRouteParams {
+		return echo.NewHTTPError(http.StatusBadRequest, "a maximum of 10 stops or vehicles can be requested at once")
+	}
+
+	predictions, err := h.ctaService.GetPredictions(c.Request().Context(), stopIDs, vehicleIDs)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, predictions)
+}
+
+// GetServiceBulletins handles GET /api/bulletins?rt=9,22 (rt is optional)
+func (h *Handlers) GetServiceBulletins(c echo.Context) error {
+	routeParam := strings.TrimSpace(c.QueryParam("rt"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "routes", routeParam)
+
+	routeIDs := splitIdentifiers(routeParam)
+	if len(routeIDs) > maxRouteParams {
+		return echo.NewHTTPError(http.StatusBadRequest, "a maximum of 10 routes can be requested at once")
+	}
+
+	bulletins, err := h.ctaService.GetServiceBulletins(c.Request().Context(), routeIDs)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, bulletins)
+}
+
+// GetDetours handles GET /api/detours?rt=9,22 (rt is optional)
+func (h *Handlers) GetDetours(c echo.Context) error {
+	routeParam := strings.TrimSpace(c.QueryParam("rt"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "routes", routeParam)
+
+	detours, err := h.ctaService.GetDetours(c.Request().Context(), splitIdentifiers(routeParam))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, detours)
+}
+
+// GetDirections handles GET /api/routes/:route/directions
+func (h *Handlers) GetDirections(c echo.Context) error {
+	routeID := strings.TrimSpace(c.Param("route"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "route", routeID)
+
+	if routeID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "route parameter is required")
+	}
+
+	directions, err := h.ctaService.GetDirections(c.Request().Context(), routeID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, directions)
+}
+
+// GetStops handles GET /api/routes/:route/stops?dir=Northbound
+func (h *Handlers) GetStops(c echo.Context) error {
+	routeID := strings.TrimSpace(c.Param("route"))
+	dir := strings.TrimSpace(c.QueryParam("dir"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "route", routeID, "direction", dir)
+
+	if routeID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "route parameter is required")
+	}
+	if dir == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "query parameter 'dir' is required (see /api/routes/:route/directions)")
+	}
+
+	stops, err := h.ctaService.GetStops(c.Request().Context(), routeID, dir)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, stops)
+}
+
+// GetPattern handles GET /api/patterns/:pid
+func (h *Handlers) GetPattern(c echo.Context) error {
+	patternID := strings.TrimSpace(c.Param("pid"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "pattern", patternID)
+
+	if patternID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "pattern ID parameter is required")
+	}
+
+	p, err := h.ctaService.GetPattern(c.Request().Context(), patternID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, p)
+}
+
+// GetRoutePatterns handles GET /api/routes/:route/patterns
+func (h *Handlers) GetRoutePatterns(c echo.Context) error {
+	routeID := strings.TrimSpace(c.Param("route"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "route", routeID)
+
+	if routeID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "route parameter is required")
+	}
+
+	patterns, err := h.ctaService.GetRoutePatterns(c.Request().Context(), routeID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, patterns)
+}
+
+func filterVehiclesByRoute(vehicles []vehicle, routeIDs []string) []vehicle {
+	wanted := make(map[string]bool, len(routeIDs))
+	for _, rt := range routeIDs {
+		wanted[rt] = true
+	}
+	filtered := make([]vehicle, 0)
+	for _, v := range vehicles {
+		if wanted[v.Route] {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+// splitIdentifiers splits a comma-separated query parameter, dropping blank entries.
+func splitIdentifiers(param string) []string {
+	ids := make([]string, 0)
+	for _, id := range strings.Split(param, ",") {
+		trimmed := strings.TrimSpace(id)
+		if trimmed == "" {
+			continue
+		}
+		ids = append(ids, trimmed)
+	}
+	return ids
 }
 
 func writeError(c echo.Context, err error) error {
 	if apiErr, ok := err.(*apiError); ok {
+		if apiErr.retryAfter > 0 {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(apiErr.retryAfter.Seconds())))
+		}
 		if apiErr.payload != nil {
 			return c.JSON(apiErr.status, apiErr.payload)
 		}
@@ -297,22 +799,128 @@ func (h *RidershipHandlers) GetDailyTotals(c echo.Context) error {
 	return c.JSON(http.StatusOK, totals)
 }
 
+// TrainHandlers handles HTTP requests for Train Tracker data and the local L station catalog
+type TrainHandlers struct {
+	service  *TrainService
+	stations *CatalogStore
+	logger   *slog.Logger
+}
+
+func NewTrainHandlers(service *TrainService, stations *CatalogStore, logger *slog.Logger) *TrainHandlers {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &TrainHandlers{service: service, stations: stations, logger: logger}
+}
+
+// GetTrainLocations handles GET /api/trains/locations?line=red,blue (line is optional)
+func (h *TrainHandlers) GetTrainLocations(c echo.Context) error {
+	lineParam := strings.TrimSpace(c.QueryParam("line"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "lines", lineParam)
+
+	lines := make([]string, 0)
+	for _, l := range splitIdentifiers(lineParam) {
+		code, ok := normalizeTrainLine(l)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown line '"+l+"' (expected one of red, blue, brn, g, org, p, pink, y)")
+		}
+		lines = append(lines, code)
+	}
+
+	trains, err := h.service.GetTrainPositions(c.Request().Context(), lines)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, trains)
+}
+
+// GetTrainArrivals handles GET /api/trains/arrivals?mapid=40380
+func (h *TrainHandlers) GetTrainArrivals(c echo.Context) error {
+	mapID := strings.TrimSpace(c.QueryParam("mapid"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "mapid", mapID)
+
+	if mapID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "query parameter 'mapid' is required (see /api/trains/stations)")
+	}
+	if _, err := strconv.Atoi(mapID); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid mapid parameter")
+	}
+
+	arrivals, err := h.service.GetArrivals(c.Request().Context(), mapID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, arrivals)
+}
+
+// GetStations handles GET /api/trains/stations?q=clark&line=blue (both optional)
+func (h *TrainHandlers) GetStations(c echo.Context) error {
+	query := strings.TrimSpace(c.QueryParam("q"))
+	lineParam := strings.TrimSpace(c.QueryParam("line"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "q", query, "line", lineParam)
+
+	line := ""
+	if lineParam != "" {
+		code, ok := normalizeTrainLine(lineParam)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown line '"+lineParam+"' (expected one of red, blue, brn, g, org, p, pink, y)")
+		}
+		line = code
+	}
+
+	stations, err := h.stations.SearchStations(query, line)
+	if err != nil {
+		h.logger.Error("failed to search stations", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, stations)
+}
+
+// GetStation handles GET /api/trains/stations/:mapid
+func (h *TrainHandlers) GetStation(c echo.Context) error {
+	mapID := strings.TrimSpace(c.Param("mapid"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "mapid", mapID)
+
+	st, found, err := h.stations.GetStation(mapID)
+	if err != nil {
+		h.logger.Error("failed to get station", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "station "+mapID+" not found")
+	}
+
+	return c.JSON(http.StatusOK, st)
+}
+
 type APITrackerHandlers struct {
 	tracker *APICallTracker
+	budget  *QuotaBudget
 	logger  *slog.Logger
 }
 
-func NewAPITrackerHandlers(tracker *APICallTracker, logger *slog.Logger) *APITrackerHandlers {
+// NewAPITrackerHandlers creates the tracking handlers. budget is optional;
+// when set, the BusTime daily budget is included in the counts response.
+func NewAPITrackerHandlers(tracker *APICallTracker, budget *QuotaBudget, logger *slog.Logger) *APITrackerHandlers {
 	if logger == nil {
 		logger = slog.Default()
 	}
-	return &APITrackerHandlers{tracker: tracker, logger: logger}
+	return &APITrackerHandlers{tracker: tracker, budget: budget, logger: logger}
 }
 
 type APICallCountResponse struct {
 	Total      int64            `json:"total"`
 	Today      int64            `json:"today"`
+	TodayByAPI map[string]int64 `json:"todayByApi"`
 	ByEndpoint map[string]int64 `json:"byEndpoint"`
+	Budget     *budgetStatus    `json:"budget,omitempty"`
 }
 
 // GetAPICallCounts handles GET /api/tracking/counts
@@ -331,15 +939,94 @@ func (h *APITrackerHandlers) GetAPICallCounts(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
+	todayByAPI, err := h.tracker.GetCountTodayByAPI()
+	if err != nil {
+		h.logger.Error("failed to get today count by API", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
 	byEndpoint, err := h.tracker.GetCountByEndpoint()
 	if err != nil {
 		h.logger.Error("failed to get count by endpoint", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, APICallCountResponse{
+	response := APICallCountResponse{
 		Total:      total,
 		Today:      today,
+		TodayByAPI: todayByAPI,
 		ByEndpoint: byEndpoint,
+	}
+	if h.budget != nil {
+		status := h.budget.Status()
+		response.Budget = &status
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// HistoryHandlers serves playback of recorded vehicle positions
+type HistoryHandlers struct {
+	store  *HistoryStore
+	logger *slog.Logger
+}
+
+func NewHistoryHandlers(store *HistoryStore, logger *slog.Logger) *HistoryHandlers {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &HistoryHandlers{store: store, logger: logger}
+}
+
+// GetVehicleFrames handles GET /api/history/vehicles?from=...&to=...&rt=9,22&step=30s
+// from and to are RFC3339 and default to the last hour; rt is optional.
+func (h *HistoryHandlers) GetVehicleFrames(c echo.Context) error {
+	routeParam := strings.TrimSpace(c.QueryParam("rt"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "routes", routeParam)
+
+	from, to, err := parsePlaybackRange(c.QueryParam("from"), c.QueryParam("to"), time.Now())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	step, err := parsePlaybackStep(c.QueryParam("step"), from, to)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	routeIDs := splitIdentifiers(routeParam)
+
+	positions, err := h.store.Positions(c.Request().Context(), from.Add(-playbackMaxGap), to.Add(playbackMaxGap), routeIDs)
+	if err != nil {
+		h.logger.Error("failed to get vehicle history", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, playbackResult{
+		From:        from,
+		To:          to,
+		StepSeconds: int(step.Seconds()),
+		Routes:      routeIDs,
+		Frames:      buildPlaybackFrames(positions, from, to, step),
 	})
 }
+
+// GetVehicleTrack handles GET /api/history/vehicles/:vid?from=...&to=...
+func (h *HistoryHandlers) GetVehicleTrack(c echo.Context) error {
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path())
+
+	vid := strings.TrimSpace(c.Param("vid"))
+	if vid == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "vid parameter is required")
+	}
+	from, to, err := parsePlaybackRange(c.QueryParam("from"), c.QueryParam("to"), time.Now())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	positions, err := h.store.Track(c.Request().Context(), vid, from, to)
+	if err != nil {
+		h.logger.Error("failed to get vehicle track", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, vehicleTrack{VehicleID: vid, From: from, To: to, Positions: positions})
+}
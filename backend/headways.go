@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Below this a bus is treated as stopped and its speed isn't used to
+	// estimate how long it will take to cover a gap
+	minHeadwaySpeedMPH = 1.0
+
+	speedSourceObserved = "observed"
+	speedSourceReported = "reported"
+	speedSourcePattern  = "pattern"
+)
+
+// headwayGap is the gap between a bus and the one ahead of it on the same
+// pattern. TimeSeconds estimates how long the following bus will take to
+// reach where the leader is now, at the speed named by SpeedSource:
+// "observed" (its progress along the pattern over the last few minutes),
+// "reported" (BusTime's spd) or "pattern" (the average of the buses on the
+// pattern other than the leader, which may be sitting at a stop or running
+// ahead of a gap it opened). It is null when no speed is known.
+type headwayGap struct {
+	LeadVehicleID   string `json:"leadVehicleId"`
+	FollowVehicleID string `json:"followVehicleId"`
+	DistanceFeet    int    `json:"distanceFeet"`
+	TimeSeconds     *int   `json:"timeSeconds"`
+	SpeedSource     string `json:"speedSource,omitempty"`
+}
+
+// headwaySummary describes a set of gaps. The coefficient of variation
+// (standard deviation over mean) is 0 for perfectly even service and grows
+// as buses bunch up and leave holes behind them.
+type headwaySummary struct {
+	Count                  int     `json:"count"`
+	Average                float64 `json:"average"`
+	Max                    float64 `json:"max"`
+	CoefficientOfVariation float64 `json:"coefficientOfVariation"`
+}
+
+type patternHeadways struct {
+	PatternID   string          `json:"patternId"`
+	Destination string          `json:"destination"`
+	Vehicles    int             `json:"vehicles"`
+	Gaps        []headwayGap    `json:"gaps"`
+	Distance    *headwaySummary `json:"distanceFeet"`
+	Time        *headwaySummary `json:"timeSeconds"`
+}
+
+// routeHeadways is the /api/routes/:route/headways response. The route-wide
+// summaries cover the gaps on every pattern.
+type routeHeadways struct {
+	Route    string            `json:"route"`
+	Patterns []patternHeadways `json:"patterns"`
+	Distance *headwaySummary   `json:"distanceFeet"`
+	Time     *headwaySummary   `json:"timeSeconds"`
+}
+
+// buildRouteHeadways computes the gaps between consecutive buses on each of
+// the route's patterns. observedSpeed returns a vehicle's recent speed in
+// feet per second, if known.
+func buildRouteHeadways(routeID string, vehicles []vehicle, observedSpeed func(vehicleID string) (float64, bool)) routeHeadways {
+	result := routeHeadways{Route: routeID, Patterns: make([]patternHeadways, 0)}
+	var allDistances, allTimes []float64
+
+	for patternID, positions := range vehiclesByPattern(vehicles) {
+		speeds := make([]float64, len(positions))
+		sources := make([]string, len(positions))
+		var knownSum float64
+		known := 0
+		for i, p := range positions {
+			speeds[i], sources[i] = vehicleSpeed(p.vehicle, observedSpeed)
+			if sources[i] != "" {
+				knownSum += speeds[i]
+				known++
+			}
+		}
+
+		pattern := patternHeadways{
+			PatternID:   patternID,
+			Destination: positions[0].vehicle.Destination,
+			Vehicles:    len(positions),
+			Gaps:        make([]headwayGap, 0, len(positions)),
+		}
+		var distances, times []float64
+		for i := 1; i < len(positions); i++ {
+			ahead, behind := positions[i-1], positions[i]
+			gap := headwayGap{
+				LeadVehicleID:   ahead.vehicle.VehicleID,
+				FollowVehicleID: behind.vehicle.VehicleID,
+				DistanceFeet:    ahead.pdist - behind.pdist,
+			}
+			speed, source := speeds[i], sources[i]
+			if source == "" {
+				// The follower's speed is unknown, so only the leader's can
+				// be among the known ones
+				sum, n := knownSum, known
+				if sources[i-1] != "" {
+					sum, n = sum-speeds[i-1], n-1
+				}
+				if n > 0 {
+					speed, source = sum/float64(n), speedSourcePattern
+				}
+			}
+			if source != "" {
+				seconds := int(math.Round(float64(gap.DistanceFeet) / speed))
+				gap.TimeSeconds = &seconds
+				gap.SpeedSource = source
+				times = append(times, float64(seconds))
+			}
+			distances = append(distances, float64(gap.DistanceFeet))
+			pattern.Gaps = append(pattern.Gaps, gap)
+		}
+		pattern.Distance = summarizeHeadways(distances)
+		pattern.Time = summarizeHeadways(times)
+		result.Patterns = append(result.Patterns, pattern)
+		allDistances = append(allDistances, distances...)
+		allTimes = append(allTimes, times...)
+	}
+
+	sort.Slice(result.Patterns, func(i, j int) bool { return result.Patterns[i].PatternID < result.Patterns[j].PatternID })
+	result.Distance = summarizeHeadways(allDistances)
+	result.Time = summarizeHeadways(allTimes)
+	return result
+}
+
+// vehicleSpeed returns a vehicle's speed in feet per second and where it
+// came from, preferring observed progress over BusTime's instantaneous spd.
+// The source is empty when neither is usable.
+func vehicleSpeed(v vehicle, observedSpeed func(vehicleID string) (float64, bool)) (float64, string) {
+	minSpeed := minHeadwaySpeedMPH * feetPerSecondPerMPH
+	if speed, ok := observedSpeed(v.VehicleID); ok && speed >= minSpeed {
+		return speed, speedSourceObserved
+	}
+	if mph, err := strconv.Atoi(strings.TrimSpace(v.Speed)); err == nil && float64(mph) >= minHeadwaySpeedMPH {
+		return float64(mph) * feetPerSecondPerMPH, speedSourceReported
+	}
+	return 0, ""
+}
+
+// summarizeHeadways returns nil when there are no gaps.
+func summarizeHeadways(gaps []float64) *headwaySummary {
+	if len(gaps) == 0 {
+		return nil
+	}
+	average := mean(gaps)
+	summary := &headwaySummary{Count: len(gaps), Average: roundTo(average, 1)}
+	var variance float64
+	for _, g := range gaps {
+		summary.Max = math.Max(summary.Max, g)
+		variance += (g - average) * (g - average)
+	}
+	if average > 0 {
+		summary.CoefficientOfVariation = roundTo(math.Sqrt(variance/float64(len(gaps)))/average, 3)
+	}
+	return summary
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func roundTo(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
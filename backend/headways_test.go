@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMotionTrackerSpeed(t *testing.T) {
+	motion := newMotionTracker()
+	motion.observe([]vehicle{{VehicleID: "1", PatternID: "100", PatternDistance: "1000", Timestamp: "20240612 08:15"}})
+	if _, ok := motion.speed("1"); ok {
+		t.Fatal("expected no speed from a single sample")
+	}
+
+	// The same CTA timestamp again is not a new sample
+	motion.observe([]vehicle{{VehicleID: "1", PatternID: "100", PatternDistance: "1500", Timestamp: "20240612 08:15"}})
+	motion.observe([]vehicle{{VehicleID: "1", PatternID: "100", PatternDistance: "2200", Timestamp: "20240612 08:16"}})
+	if speed, ok := motion.speed("1"); !ok || speed != 20 {
+		t.Fatalf("expected 20 ft/s, got %v (ok=%v)", speed, ok)
+	}
+
+	// A new trip starts the estimate over
+	motion.observe([]vehicle{{VehicleID: "1", PatternID: "101", PatternDistance: "100", Timestamp: "20240612 08:17"}})
+	if _, ok := motion.speed("1"); ok {
+		t.Fatal("expected no speed right after a pattern change")
+	}
+
+	// Samples older than the window are dropped
+	motion.observe([]vehicle{{VehicleID: "1", PatternID: "101", PatternDistance: "6100", Timestamp: "20240612 08:27"}})
+	if _, ok := motion.speed("1"); ok {
+		t.Fatal("expected the old samples to have expired")
+	}
+}
+
+func TestBuildRouteHeadways(t *testing.T) {
+	vehicles := []vehicle{
+		{VehicleID: "1", Route: "9", PatternID: "100", PatternDistance: "30000", Destination: "95th Street"},
+		{VehicleID: "2", Route: "9", PatternID: "100", PatternDistance: "20000", Speed: "15"},
+		{VehicleID: "3", Route: "9", PatternID: "100", PatternDistance: "18000", Speed: "0"},
+		{VehicleID: "4", Route: "9", PatternID: "101", PatternDistance: "5000"},
+		{VehicleID: "5", Route: "9", PatternID: "102", PatternDistance: "9000", Speed: "10"},
+		{VehicleID: "6", Route: "9", PatternID: "102", PatternDistance: "4000"},
+	}
+	observed := func(vehicleID string) (float64, bool) {
+		if vehicleID == "1" {
+			return 30, true
+		}
+		return 0, false
+	}
+
+	result := buildRouteHeadways("9", vehicles, observed)
+	if len(result.Patterns) != 3 {
+		t.Fatalf("expected 3 patterns, got %d", len(result.Patterns))
+	}
+	southbound := result.Patterns[0]
+	if southbound.Vehicles != 3 || len(southbound.Gaps) != 2 {
+		t.Fatalf("unexpected pattern %+v", southbound)
+	}
+
+	// Bus 2 reports 15 mph (22 ft/s); bus 3 is stopped, so it gets the
+	// average of the other buses, leaving out bus 2 ahead of it: 30 ft/s
+	first, second := southbound.Gaps[0], southbound.Gaps[1]
+	if first.DistanceFeet != 10000 || first.SpeedSource != speedSourceReported || *first.TimeSeconds != 455 {
+		t.Fatalf("unexpected first gap %+v", first)
+	}
+	if second.DistanceFeet != 2000 || second.SpeedSource != speedSourcePattern || *second.TimeSeconds != 67 {
+		t.Fatalf("unexpected second gap %+v", second)
+	}
+
+	distance := southbound.Distance
+	if distance.Count != 2 || distance.Average != 6000 || distance.Max != 10000 || math.Abs(distance.CoefficientOfVariation-0.667) > 1e-9 {
+		t.Fatalf("unexpected distance summary %+v", distance)
+	}
+	if result.Patterns[1].Distance != nil || result.Patterns[1].Time != nil {
+		t.Fatalf("expected no summaries for a single bus, got %+v", result.Patterns[1])
+	}
+	// Bus 6's only possible pattern speed would be its leader's own
+	if gap := result.Patterns[2].Gaps[0]; gap.DistanceFeet != 5000 || gap.TimeSeconds != nil || gap.SpeedSource != "" {
+		t.Fatalf("expected no time for a gap with only the leader's speed, got %+v", gap)
+	}
+	if result.Distance.Count != 3 || result.Time.Count != 2 {
+		t.Fatalf("unexpected route summary %+v / %+v", result.Distance, result.Time)
+	}
+}
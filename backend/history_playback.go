@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPlaybackStep   = 30 * time.Second
+	minPlaybackStep       = 5 * time.Second
+	defaultPlaybackWindow = time.Hour
+	maxPlaybackFrames     = 2880
+	// A vehicle missing for longer than this is treated as out of service
+	// rather than interpolated across the gap
+	playbackMaxGap = 5 * time.Minute
+	// BusTime timestamps have minute resolution, so a vehicle is held at its
+	// last position for up to a minute before it disappears from playback
+	playbackHold = time.Minute
+)
+
+// playbackVehicle is one vehicle in a playback frame. Interpolated is true
+// when the position was estimated between two recorded positions rather
+// than recorded at the frame's time.
+type playbackVehicle struct {
+	VehicleID       string  `json:"vehicleId"`
+	Route           string  `json:"route"`
+	PatternID       string  `json:"patternId"`
+	PatternDistance int     `json:"patternDistance"`
+	Latitude        float64 `json:"latitude"`
+	Longitude       float64 `json:"longitude"`
+	Heading         int     `json:"heading"`
+	Delayed         bool    `json:"delayed"`
+	Interpolated    bool    `json:"interpolated"`
+}
+
+type playbackFrame struct {
+	Time     time.Time         `json:"time"`
+	Vehicles []playbackVehicle `json:"vehicles"`
+}
+
+// playbackResult is the /api/history/vehicles response: one frame every
+// StepSeconds from From to To.
+type playbackResult struct {
+	From        time.Time       `json:"from"`
+	To          time.Time       `json:"to"`
+	StepSeconds int             `json:"stepSeconds"`
+	Routes      []string        `json:"routes"`
+	Frames      []playbackFrame `json:"frames"`
+}
+
+// vehicleTrack is the /api/history/vehicles/:vid response: the positions
+// recorded for one vehicle, oldest first.
+type vehicleTrack struct {
+	VehicleID string            `json:"vehicleId"`
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+	Positions []historyPosition `json:"positions"`
+}
+
+// parsePlaybackRange parses the from/to query parameters (RFC3339). to
+// defaults to now and from to an hour before to.
+func parsePlaybackRange(fromParam string, toParam string, now time.Time) (time.Time, time.Time, error) {
+	to := now
+	if toParam = strings.TrimSpace(toParam); toParam != "" {
+		parsed, err := time.Parse(time.RFC3339, toParam)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to parameter (expected RFC3339, e.g. 2024-01-15T08:00:00-06:00)")
+		}
+		to = parsed
+	}
+	from := to.Add(-defaultPlaybackWindow)
+	if fromParam = strings.TrimSpace(fromParam); fromParam != "" {
+		parsed, err := time.Parse(time.RFC3339, fromParam)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from parameter (expected RFC3339, e.g. 2024-01-15T07:00:00-06:00)")
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from.In(chicagoLocation), to.In(chicagoLocation), nil
+}
+
+// parsePlaybackStep parses the step query parameter, a Go duration such as
+// 30s or 1m, and checks the range fits in maxPlaybackFrames frames.
+func parsePlaybackStep(stepParam string, from time.Time, to time.Time) (time.Duration, error) {
+	step := defaultPlaybackStep
+	if stepParam = strings.TrimSpace(stepParam); stepParam != "" {
+		parsed, err := time.ParseDuration(stepParam)
+		if err != nil || parsed < minPlaybackStep || parsed%time.Second != 0 {
+			return 0, fmt.Errorf("invalid step parameter (must be a whole number of seconds, at least %s)", minPlaybackStep)
+		}
+		step = parsed
+	}
+	if frames := to.Sub(from)/step + 1; frames > maxPlaybackFrames {
+		return 0, fmt.Errorf("range from %s to %s at %s steps is %d frames; the maximum is %d", from.Format(time.RFC3339), to.Format(time.RFC3339), step, frames, maxPlaybackFrames)
+	}
+	return step, nil
+}
+
+// buildPlaybackFrames places each vehicle onto a frame every step from from
+// to to. positions must be ordered by vehicle and then time, as returned by
+// HistoryStore.Positions, and should cover playbackMaxGap either side of the
+// range so vehicles can be interpolated at its edges.
+func buildPlaybackFrames(positions []historyPosition, from time.Time, to time.Time, step time.Duration) []playbackFrame {
+	frames := make([]playbackFrame, 0, int(to.Sub(from)/step)+1)
+	for t := from; !t.After(to); t = t.Add(step) {
+		frames = append(frames, playbackFrame{Time: t, Vehicles: make([]playbackVehicle, 0)})
+	}
+
+	for start := 0; start < len(positions); {
+		end := start + 1
+		for end < len(positions) && positions[end].VehicleID == positions[start].VehicleID {
+			end++
+		}
+		track := positions[start:end]
+		start = end
+
+		for i := range frames {
+			if v, ok := positionAt(track, frames[i].Time); ok {
+				frames[i].Vehicles = append(frames[i].Vehicles, v)
+			}
+		}
+	}
+
+	for i := range frames {
+		sort.Slice(frames[i].Vehicles, func(a, b int) bool {
+			return frames[i].Vehicles[a].VehicleID < frames[i].Vehicles[b].VehicleID
+		})
+	}
+	return frames
+}
+
+// positionAt estimates where a vehicle was at t from its time-ordered track.
+// Positions on the same pattern are interpolated linearly; across a pattern
+// change (the end of a trip) the earlier position is held.
+func positionAt(track []historyPosition, t time.Time) (playbackVehicle, bool) {
+	// First recorded position after t
+	next := sort.Search(len(track), func(i int) bool { return track[i].Timestamp.After(t) })
+	if next == 0 {
+		return playbackVehicle{}, false
+	}
+	before := track[next-1]
+	if before.Timestamp.Equal(t) {
+		return toPlaybackVehicle(before, false), true
+	}
+	if next == len(track) || track[next].Timestamp.Sub(before.Timestamp) > playbackMaxGap {
+		if t.Sub(before.Timestamp) > playbackHold {
+			return playbackVehicle{}, false
+		}
+		return toPlaybackVehicle(before, true), true
+	}
+
+	after := track[next]
+	if after.PatternID != before.PatternID {
+		return toPlaybackVehicle(before, true), true
+	}
+
+	fraction := float64(t.Sub(before.Timestamp)) / float64(after.Timestamp.Sub(before.Timestamp))
+	v := toPlaybackVehicle(before, true)
+	v.Latitude = before.Latitude + (after.Latitude-before.Latitude)*fraction
+	v.Longitude = before.Longitude + (after.Longitude-before.Longitude)*fraction
+	v.PatternDistance = before.PatternDistance + int(math.Round(float64(after.PatternDistance-before.PatternDistance)*fraction))
+	v.Heading = interpolateHeading(before.Heading, after.Heading, fraction)
+	return v, true
+}
+
+// interpolateHeading turns the shorter way round, so 350° to 10° passes
+// through 0° rather than 180°.
+func interpolateHeading(from int, to int, fraction float64) int {
+	delta := (to-from+540)%360 - 180
+	heading := from + int(math.Round(float64(delta)*fraction))
+	return (heading%360 + 360) % 360
+}
+
+func toPlaybackVehicle(p historyPosition, interpolated bool) playbackVehicle {
+	return playbackVehicle{
+		VehicleID:       p.VehicleID,
+		Route:           p.Route,
+		PatternID:       p.PatternID,
+		PatternDistance: p.PatternDistance,
+		Latitude:        p.Latitude,
+		Longitude:       p.Longitude,
+		Heading:         p.Heading,
+		Delayed:         p.Delayed,
+		Interpolated:    interpolated,
+	}
+}
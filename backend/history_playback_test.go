@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestInterpolateHeading(t *testing.T) {
+	for _, tc := range []struct {
+		from, to int
+		fraction float64
+		want     int
+	}{
+		{90, 180, 0.5, 135},
+		{180, 90, 0.5, 135},
+		{350, 10, 0.5, 0},
+		{350, 10, 0.25, 355},
+		{10, 350, 0.75, 355},
+		{0, 180, 0, 0},
+		{0, 180, 1, 180},
+	} {
+		if got := interpolateHeading(tc.from, tc.to, tc.fraction); got != tc.want {
+			t.Fatalf("%d° to %d° at %v: expected %d°, got %d°", tc.from, tc.to, tc.fraction, tc.want, got)
+		}
+	}
+}
+
+func TestPositionAt(t *testing.T) {
+	base := time.Date(2024, 6, 12, 8, 15, 0, 0, chicagoLocation)
+	at := func(offset time.Duration) time.Time { return base.Add(offset) }
+	track := []historyPosition{
+		{VehicleID: "1", PatternID: "5425", PatternDistance: 1000, Latitude: 41.88, Longitude: -87.66, Heading: 350, Timestamp: at(0)},
+		{VehicleID: "1", PatternID: "5425", PatternDistance: 3000, Latitude: 41.90, Longitude: -87.64, Heading: 10, Timestamp: at(2 * time.Minute)},
+		// End of the trip: the next position is on another pattern
+		{VehicleID: "1", PatternID: "5424", PatternDistance: 0, Latitude: 41.95, Longitude: -87.60, Heading: 180, Timestamp: at(4 * time.Minute)},
+		// Out of service for longer than playbackMaxGap
+		{VehicleID: "1", PatternID: "5424", PatternDistance: 500, Latitude: 41.94, Longitude: -87.60, Heading: 180, Timestamp: at(15 * time.Minute)},
+	}
+
+	for _, tc := range []struct {
+		name         string
+		t            time.Time
+		ok           bool
+		interpolated bool
+		pdist        int
+		heading      int
+		lat          float64
+	}{
+		{name: "before the first position", t: at(-time.Second)},
+		{name: "recorded", t: at(0), ok: true, pdist: 1000, heading: 350, lat: 41.88},
+		{name: "halfway", t: at(time.Minute), ok: true, interpolated: true, pdist: 2000, heading: 0, lat: 41.89},
+		{name: "a quarter of the way", t: at(30 * time.Second), ok: true, interpolated: true, pdist: 1500, heading: 355, lat: 41.885},
+		{name: "held across a pattern change", t: at(3 * time.Minute), ok: true, interpolated: true, pdist: 3000, heading: 10, lat: 41.90},
+		{name: "held at the start of a gap", t: at(5 * time.Minute), ok: true, interpolated: true, pdist: 0, heading: 180, lat: 41.95},
+		{name: "inside a gap", t: at(5*time.Minute + time.Second)},
+		{name: "held after the last position", t: at(16 * time.Minute), ok: true, interpolated: true, pdist: 500, heading: 180, lat: 41.94},
+		{name: "after the last position", t: at(16*time.Minute + time.Second)},
+	} {
+		v, ok := positionAt(track, tc.t)
+		if ok != tc.ok {
+			t.Fatalf("%s: expected ok=%v, got %+v (ok=%v)", tc.name, tc.ok, v, ok)
+		}
+		if !ok {
+			continue
+		}
+		if v.Interpolated != tc.interpolated || v.PatternDistance != tc.pdist || v.Heading != tc.heading || math.Abs(v.Latitude-tc.lat) > 1e-9 {
+			t.Fatalf("%s: unexpected position %+v", tc.name, v)
+		}
+	}
+}
+
+func TestBuildPlaybackFrames(t *testing.T) {
+	base := time.Date(2024, 6, 12, 8, 15, 0, 0, chicagoLocation)
+	positions := []historyPosition{
+		{VehicleID: "1311", Route: "9", PatternID: "5425", PatternDistance: 1000, Timestamp: base},
+		{VehicleID: "1311", Route: "9", PatternID: "5425", PatternDistance: 2000, Timestamp: base.Add(time.Minute)},
+		{VehicleID: "1100", Route: "9", PatternID: "5424", PatternDistance: 500, Timestamp: base.Add(30 * time.Second)},
+	}
+
+	frames := buildPlaybackFrames(positions, base, base.Add(2*time.Minute), 30*time.Second)
+	if len(frames) != 5 {
+		t.Fatalf("expected 5 frames, got %d", len(frames))
+	}
+	for i, want := range []string{"1311", "1100,1311", "1100,1311", "1100,1311", "1311"} {
+		var got string
+		for j, v := range frames[i].Vehicles {
+			if j > 0 {
+				got += ","
+			}
+			got += v.VehicleID
+		}
+		if got != want || !frames[i].Time.Equal(base.Add(time.Duration(i)*30*time.Second)) {
+			t.Fatalf("frame %d at %s: expected vehicles %s, got %s", i, frames[i].Time, want, got)
+		}
+	}
+	if v := frames[1].Vehicles[1]; v.PatternDistance != 1500 || !v.Interpolated {
+		t.Fatalf("expected 1311 interpolated to 1500 ft, got %+v", v)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	historyDBPathEnv        = "VEHICLE_HISTORY_DB_PATH"
+	historyRetentionEnv     = "VEHICLE_HISTORY_RETENTION"
+	defaultHistoryRetention = 7 * 24 * time.Hour
+	historyPruneInterval    = time.Hour
+	historyQueueSize        = 64
+)
+
+// HistoryStore records vehicle positions to their own SQLite database so
+// headways, speeds and delays can be analysed later. Positions are written
+// by a background goroutine; Record never blocks the request that fetched
+// them. A vehicle is stored once per CTA timestamp, however many times it
+// is fetched.
+type HistoryStore struct {
+	db        *sql.DB
+	retention time.Duration
+	logger    *slog.Logger
+	queue     chan []vehicle
+}
+
+// historyPosition is one recorded vehicle position.
+type historyPosition struct {
+	VehicleID       string    `json:"vehicleId"`
+	Route           string    `json:"route"`
+	PatternID       string    `json:"patternId"`
+	PatternDistance int       `json:"patternDistance"`
+	Latitude        float64   `json:"latitude"`
+	Longitude       float64   `json:"longitude"`
+	Heading         int       `json:"heading"`
+	Delayed         bool      `json:"delayed"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+func NewHistoryStore(dbPath string, retention time.Duration, logger *slog.Logger) (*HistoryStore, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	store := &HistoryStore{
+		db:        db,
+		retention: retention,
+		logger:    logger,
+		queue:     make(chan []vehicle, historyQueueSize),
+	}
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// recorded_at is the CTA timestamp in Unix seconds, so time-range scans use
+// the indexes directly.
+func (h *HistoryStore) initSchema() error {
+	_, err := h.db.Exec(`
+		CREATE TABLE IF NOT EXISTS vehicle_positions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			vid TEXT NOT NULL,
+			route TEXT NOT NULL,
+			pattern_id TEXT NOT NULL,
+			pdist INTEGER NOT NULL,
+			latitude REAL NOT NULL,
+			longitude REAL NOT NULL,
+			heading INTEGER NOT NULL,
+			delayed INTEGER NOT NULL,
+			recorded_at INTEGER NOT NULL,
+			UNIQUE (vid, recorded_at)
+		);
+		CREATE INDEX IF NOT EXISTS idx_vehicle_positions_recorded_at ON vehicle_positions(recorded_at);
+		CREATE INDEX IF NOT EXISTS idx_vehicle_positions_route_recorded_at ON vehicle_positions(route, recorded_at);
+	`)
+	return err
+}
+
+func (h *HistoryStore) Close() error {
+	return h.db.Close()
+}
+
+// Start writes queued positions and prunes rows older than the retention
+// period until ctx is cancelled.
+func (h *HistoryStore) Start(ctx context.Context) {
+	go func() {
+		h.prune()
+
+		ticker := time.NewTicker(historyPruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case vehicles := <-h.queue:
+				if err := h.insert(vehicles); err != nil {
+					h.logger.Error("failed to record vehicle history", "error", err)
+				}
+			case <-ticker.C:
+				h.prune()
+			}
+		}
+	}()
+}
+
+// Record queues vehicles to be written. If the writer has fallen behind the
+// batch is dropped rather than slowing down the caller.
+func (h *HistoryStore) Record(vehicles []vehicle) {
+	if len(vehicles) == 0 {
+		return
+	}
+	select {
+	case h.queue <- vehicles:
+	default:
+		h.logger.Warn("vehicle history queue full; dropping positions", "vehicles", len(vehicles))
+	}
+}
+
+func (h *HistoryStore) insert(vehicles []vehicle) error {
+	// Only the stored columns are validated, so a bad optional v3 field
+	// doesn't lose the position
+	positions := make([]vehicleV2, 0, len(vehicles))
+	invalid := 0
+	for _, v := range vehicles {
+		position, errs := vehiclePosition(v)
+		if len(errs) > 0 {
+			invalid++
+			continue
+		}
+		positions = append(positions, position)
+	}
+	if invalid > 0 {
+		h.logger.Warn("skipping invalid vehicle rows in history", "invalid", invalid)
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO vehicle_positions (vid, route, pattern_id, pdist, latitude, longitude, heading, delayed, recorded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, v := range positions {
+		if _, err := stmt.Exec(v.VehicleID, v.Route, v.PatternID, v.PatternDistance, v.Latitude, v.Longitude, v.Heading, v.Delayed, v.Timestamp.Unix()); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (h *HistoryStore) prune() {
+	if h.retention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-h.retention).Unix()
+	result, err := h.db.Exec(`DELETE FROM vehicle_positions WHERE recorded_at < ?`, cutoff)
+	if err != nil {
+		h.logger.Error("failed to prune vehicle history", "error", err)
+		return
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+		h.logger.Info("pruned vehicle history", "deleted", deleted, "retention", h.retention)
+	}
+}
+
+// Positions returns the positions recorded between from and to (inclusive),
+// optionally limited to routes, ordered by vehicle and then time.
+func (h *HistoryStore) Positions(ctx context.Context, from time.Time, to time.Time, routes []string) ([]historyPosition, error) {
+	query := `
+		SELECT vid, route, pattern_id, pdist, latitude, longitude, heading, delayed, recorded_at
+		FROM vehicle_positions
+		WHERE recorded_at BETWEEN ? AND ?`
+	args := []interface{}{from.Unix(), to.Unix()}
+	if len(routes) > 0 {
+		query += ` AND route IN (?` + strings.Repeat(`, ?`, len(routes)-1) + `)`
+		for _, rt := range routes {
+			args = append(args, rt)
+		}
+	}
+	query += ` ORDER BY vid, recorded_at`
+	return h.queryPositions(ctx, query, args...)
+}
+
+// Track returns one vehicle's positions between from and to, oldest first.
+func (h *HistoryStore) Track(ctx context.Context, vehicleID string, from time.Time, to time.Time) ([]historyPosition, error) {
+	return h.queryPositions(ctx, `
+		SELECT vid, route, pattern_id, pdist, latitude, longitude, heading, delayed, recorded_at
+		FROM vehicle_positions
+		WHERE vid = ? AND recorded_at BETWEEN ? AND ?
+		ORDER BY recorded_at
+	`, vehicleID, from.Unix(), to.Unix())
+}
+
+func (h *HistoryStore) queryPositions(ctx context.Context, query string, args ...interface{}) ([]historyPosition, error) {
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	positions := make([]historyPosition, 0)
+	for rows.Next() {
+		var p historyPosition
+		var recordedAt int64
+		if err := rows.Scan(&p.VehicleID, &p.Route, &p.PatternID, &p.PatternDistance, &p.Latitude, &p.Longitude, &p.Heading, &p.Delayed, &recordedAt); err != nil {
+			return nil, err
+		}
+		p.Timestamp = time.Unix(recordedAt, 0).In(chicagoLocation)
+		positions = append(positions, p)
+	}
+	return positions, rows.Err()
+}
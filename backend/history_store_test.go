@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryStoreKeepsRowsWithBadOptionalFields(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store, err := NewHistoryStore(filepath.Join(t.TempDir(), "history.db"), 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	position := func(vid string) vehicle {
+		return vehicle{VehicleID: vid, Route: "9", PatternID: "5425", PatternDistance: "1200", Latitude: "41.88416", Longitude: "-87.66630", Heading: "180", Timestamp: "20240612 08:15"}
+	}
+	badSpeed := position("1311")
+	badSpeed.Speed = "fast"
+	badServerTimestamp := position("1862")
+	badServerTimestamp.ServerTimestamp = "yesterday"
+	badScheduledStart := position("1900")
+	badScheduledStart.ScheduledStartDate, badScheduledStart.ScheduledStart = "2024-06-12", "-5"
+	badLatitude := position("4015")
+	badLatitude.Latitude = "91"
+	badHeading := position("7960")
+	badHeading.Heading = "north"
+
+	if err := store.insert([]vehicle{badSpeed, badServerTimestamp, badScheduledStart, badLatitude, badHeading}); err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2024, 6, 12, 8, 15, 0, 0, chicagoLocation)
+	positions, err := store.Positions(context.Background(), at, at, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []string
+	for _, p := range positions {
+		stored = append(stored, p.VehicleID)
+	}
+	if len(stored) != 3 || stored[0] != "1311" || stored[1] != "1862" || stored[2] != "1900" {
+		t.Fatalf("expected only the rows with valid stored columns, got %v", stored)
+	}
+	if p := positions[0]; p.PatternDistance != 1200 || p.Heading != 180 || p.Latitude != 41.88416 || !p.Timestamp.Equal(at) {
+		t.Fatalf("unexpected stored position %+v", p)
+	}
+}
@@ -1,30 +1,38 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
-const defaultPort = "8080"
+const (
+	portEnv        = "PORT"
+	defaultPort    = "8080"
+	staticDirEnv   = "STATIC_DIR"
+	ridershipDBEnv = "RIDERSHIP_DB_PATH"
+	jawgTokenEnv   = "JAWG_ACCESS_TOKEN"
+	// allowedOriginsEnv lists the origins browsers may call the API from,
+	// comma-separated; "*" (the default) allows any for plain HTTP
+	allowedOriginsEnv = "ALLOWED_ORIGINS"
+)
 
 func main() {
 	e := echo.New()
 	e.HideBanner = true
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-		AllowMethods: []string{http.MethodGet, http.MethodOptions},
-	}))
 
 	if err := godotenv.Load(); err != nil {
 		var pathErr *fs.PathError
@@ -33,9 +41,18 @@ func main() {
 		}
 	}
 
+	allowedOrigins := splitIdentifiers(os.Getenv(allowedOriginsEnv))
+	if len(allowedOrigins) == 0 {
+		allowedOrigins = []string{"*"}
+	}
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: allowedOrigins,
+		AllowMethods: []string{http.MethodGet, http.MethodOptions},
+	}))
+
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-	apiTrackerDBPath := os.Getenv("API_TRACKER_DB_PATH")
+	apiTrackerDBPath := os.Getenv(apiTrackerDBPathEnv)
 	if apiTrackerDBPath == "" {
 		apiTrackerDBPath = filepath.Join("data", "api_tracker.db")
 	}
@@ -46,14 +63,103 @@ func main() {
 
 	apiKey := os.Getenv(apiKeyEnv)
 	client := &http.Client{Timeout: defaultHTTPTimeout}
-	ctaService, err := NewCTAService(apiKey, client, logger, apiTracker)
+
+	// Replay mode answers BusTime requests from a capture instead of CTA, so
+	// it needs no API key and its calls aren't tracked against the quota
+	busClient, busTracker := client, apiTracker
+	replaying := false
+	if replayDir := os.Getenv(replayDirEnv); replayDir != "" {
+		replay, err := newReplayTransport(replayDir, envFloat(replaySpeedEnv, 1), time.Now)
+		if err != nil {
+			e.Logger.Fatalf("failed to load replay capture: %v", err)
+		}
+		busClient = &http.Client{Timeout: defaultHTTPTimeout, Transport: replay}
+		apiKey, busTracker, replaying = replayAPIKey, nil, true
+		logger.Info("replaying BusTime capture", "dir", replayDir, "from", replay.clock.start, "to", replay.clock.end, "speed", replay.clock.speed)
+	} else if captureDir := os.Getenv(captureDirEnv); captureDir != "" {
+		capture, err := newCaptureTransport(captureDir, nil, logger)
+		if err != nil {
+			e.Logger.Fatalf("failed to create capture directory: %v", err)
+		}
+		busClient = &http.Client{Timeout: defaultHTTPTimeout, Transport: capture}
+	}
+
+	ctaService, err := NewCTAService(apiKey, os.Getenv(baseURLEnv), busClient, logger, busTracker)
 	if err != nil {
 		e.Logger.Fatalf("failed to create CTA service: %v", err)
 	}
-	handlers := NewHandlers(ctaService, logger)
+	ctaService.SetMaxConcurrency(envInt(maxConcurrencyEnv, defaultMaxConcurrency))
+	retry := retryPolicy{
+		Attempts:  envInt(retryAttemptsEnv, defaultRetryAttempts),
+		BaseDelay: envDuration(retryBaseDelayEnv, defaultRetryBaseDelay),
+		MaxDelay:  defaultRetryMaxDelay,
+	}
+	breakerThreshold := envInt(breakerThresholdEnv, defaultBreakerThreshold)
+	breakerCooldown := envDuration(breakerCooldownEnv, defaultBreakerCooldown)
+	ctaService.SetRetryPolicy(retry)
+	ctaService.SetCircuitBreaker(breakerThreshold, breakerCooldown)
+	ctaService.SetBunchingThreshold(envInt(bunchingThresholdEnv, defaultBunchingThreshold))
+	ctaService.SetAnomalyThresholds(envDuration(staleAfterEnv, defaultStaleAfter), envDuration(idleAfterEnv, defaultIdleAfter))
+	ctaService.SetRouteCacheTTL(envCacheTTL(routeCacheTTLEnv, defaultRouteCacheTTL), envDuration(routeCacheMaxStaleEnv, defaultRouteCacheMaxStale))
+	ctaService.SetBulletinCacheTTL(envCacheTTL(bulletinCacheTTLEnv, defaultBulletinCacheTTL))
+
+	// The daily budget is opt-in and counts against the tracker, so it needs the tracker database
+	var quotaBudget *QuotaBudget
+	if limit := envInt(dailyBudgetEnv, 0); limit > 0 && !replaying {
+		if apiTracker == nil {
+			e.Logger.Warnf("%s ignored: API tracker database unavailable", dailyBudgetEnv)
+		} else {
+			quotaBudget = NewQuotaBudget(apiTracker, trackedAPIBusTime, int64(limit), envFractions(budgetSoftLimitEnv, defaultBudgetSoftLimits), logger)
+			quotaBudget.Start(context.Background())
+			ctaService.SetQuotaBudget(quotaBudget)
+		}
+	}
+
+	catalogDBPath := os.Getenv(catalogDBPathEnv)
+	if catalogDBPath == "" {
+		catalogDBPath = filepath.Join("data", "catalog.db")
+	}
+	catalogStore, err := NewCatalogStore(catalogDBPath)
+	if err != nil {
+		e.Logger.Warnf("catalog cache database unavailable: %v", err)
+	} else {
+		ctaService.SetCatalogStore(catalogStore, envDuration(catalogCacheTTLEnv, defaultCatalogCacheTTL))
+	}
+
+	// History recording is opt-in and uses its own database, since it grows with every poll
+	var historyStore *HistoryStore
+	if historyDBPath := os.Getenv(historyDBPathEnv); historyDBPath != "" {
+		historyStore, err = NewHistoryStore(historyDBPath, envDuration(historyRetentionEnv, defaultHistoryRetention), logger)
+		if err != nil {
+			e.Logger.Warnf("vehicle history database unavailable: %v", err)
+		} else {
+			historyStore.Start(context.Background())
+			ctaService.SetHistoryStore(historyStore)
+		}
+	}
+
+	// Background polling is opt-in: every poll costs one BusTime call per 10 routes
+	var poller *VehiclePoller
+	if os.Getenv(pollIntervalEnv) != "" {
+		poller = NewVehiclePoller(ctaService, envDuration(pollIntervalEnv, time.Minute), logger)
+		poller.Start(context.Background())
+	}
+
+	handlers := NewHandlers(ctaService, poller, logger)
+	handlers.SetSocketOrigins(allowedOrigins)
+
+	// Train Tracker uses its own API key; live train endpoints are only served when it is configured
+	trainService, err := NewTrainService(os.Getenv(trainAPIKeyEnv), os.Getenv(trainBaseURLEnv), client, logger, apiTracker)
+	if err != nil {
+		e.Logger.Warnf("train tracker unavailable: %v", err)
+	} else {
+		trainService.SetRetryPolicy(retry)
+		trainService.SetCircuitBreaker(breakerThreshold, breakerCooldown)
+	}
+	trainHandlers := NewTrainHandlers(trainService, catalogStore, logger)
 
 	// Initialize ridership service
-	dbPath := os.Getenv("RIDERSHIP_DB_PATH")
+	dbPath := os.Getenv(ridershipDBEnv)
 	if dbPath == "" {
 		dbPath = filepath.Join("data", "ridership.db")
 	}
@@ -67,18 +173,41 @@ func main() {
 		ridershipHandlers = NewRidershipHandlers(ridershipService, logger)
 	}
 
-	e.GET("/", handlers.Health)
+	e.GET("/", NewHealthHandlers(ctaService, trainService).Health)
 
 	// Config endpoint for frontend runtime configuration
-	jawgToken := os.Getenv("JAWG_ACCESS_TOKEN")
+	jawgToken := os.Getenv(jawgTokenEnv)
 	configHandlers := NewConfigHandlers(jawgToken)
 
 	api := e.Group("/api")
 	api.GET("/config", configHandlers.GetConfig)
 	api.GET("/routes", handlers.GetRoutes)
 	api.GET("/routes/stats", handlers.GetRouteStats)
+	api.GET("/routes/:route/directions", handlers.GetDirections)
+	api.GET("/routes/:route/stops", handlers.GetStops)
+	api.GET("/routes/:route/patterns", handlers.GetRoutePatterns)
+	api.GET("/routes/:route/bunching", handlers.GetRouteBunching)
+	api.GET("/routes/:route/headways", handlers.GetRouteHeadways)
+	api.GET("/patterns/:pid", handlers.GetPattern)
 	api.GET("/vehicles/locations", handlers.GetVehicleLocations)
 	api.GET("/vehicles/all", handlers.GetAllVehicleLocations)
+	api.GET("/vehicles/anomalies", handlers.GetVehicleAnomalies)
+	api.GET("/vehicles/stream", handlers.GetVehicleStream)
+	api.GET("/vehicles/ws", handlers.GetVehicleSocket)
+	api.GET("/v2/vehicles/locations", handlers.GetVehicleLocationsV2)
+	api.GET("/v2/vehicles/all", handlers.GetAllVehicleLocationsV2)
+	api.GET("/predictions", handlers.GetPredictions)
+	api.GET("/bulletins", handlers.GetServiceBulletins)
+	api.GET("/detours", handlers.GetDetours)
+
+	if trainService != nil {
+		api.GET("/trains/locations", trainHandlers.GetTrainLocations)
+		api.GET("/trains/arrivals", trainHandlers.GetTrainArrivals)
+	}
+	if catalogStore != nil {
+		api.GET("/trains/stations", trainHandlers.GetStations)
+		api.GET("/trains/stations/:mapid", trainHandlers.GetStation)
+	}
 
 	// Ridership endpoints
 	if ridershipHandlers != nil {
@@ -91,13 +220,19 @@ func main() {
 		api.GET("/ridership/route/:route/daily", ridershipHandlers.GetRouteDaily)
 	}
 
+	if historyStore != nil {
+		historyHandlers := NewHistoryHandlers(historyStore, logger)
+		api.GET("/history/vehicles", historyHandlers.GetVehicleFrames)
+		api.GET("/history/vehicles/:vid", historyHandlers.GetVehicleTrack)
+	}
+
 	if apiTracker != nil {
-		trackerHandlers := NewAPITrackerHandlers(apiTracker, logger)
+		trackerHandlers := NewAPITrackerHandlers(apiTracker, quotaBudget, logger)
 		api.GET("/tracking/counts", trackerHandlers.GetAPICallCounts)
 	}
 
 	// Serve static frontend files if the directory exists
-	staticDir := os.Getenv("STATIC_DIR")
+	staticDir := os.Getenv(staticDirEnv)
 	if staticDir == "" {
 		staticDir = "static"
 	}
@@ -114,10 +249,84 @@ func main() {
 		}))
 	}
 
-	port := os.Getenv("PORT")
+	port := os.Getenv(portEnv)
 	if port == "" {
 		port = defaultPort
 	}
 
 	e.Logger.Fatal(e.Start(":" + port))
 }
+
+// envDuration reads a duration such as "24h" from the environment, falling
+// back to the default when the variable is unset or invalid.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		slog.Warn("ignoring invalid duration", "env", name, "value", raw)
+		return fallback
+	}
+	return d
+}
+
+// envCacheTTL reads a cache TTL like envDuration, except that "0" is
+// accepted and disables the cache.
+func envCacheTTL(name string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d == 0 {
+		return 0
+	}
+	return envDuration(name, fallback)
+}
+
+// envInt reads a positive integer from the environment, falling back to the
+// default when the variable is unset or invalid.
+func envInt(name string, fallback int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		slog.Warn("ignoring invalid integer", "env", name, "value", raw)
+		return fallback
+	}
+	return n
+}
+
+// envFloat reads a positive number from the environment, falling back to the
+// default when the variable is unset or invalid.
+func envFloat(name string, fallback float64) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f <= 0 {
+		slog.Warn("ignoring invalid number", "env", name, "value", raw)
+		return fallback
+	}
+	return f
+}
+
+// envFractions reads a comma-separated list of fractions between 0 and 1
+// (e.g. "0.75,0.9"), falling back to the default when the variable is unset
+// or any entry is invalid.
+func envFractions(name string, fallback []float64) []float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	var fractions []float64
+	for _, part := range strings.Split(raw, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || f <= 0 || f > 1 {
+			slog.Warn("ignoring invalid fraction list", "env", name, "value", raw)
+			return fallback
+		}
+		fractions = append(fractions, f)
+	}
+	return fractions
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvCacheTTL(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", time.Hour},
+		{"0", 0},
+		{"0s", 0},
+		{"10m", 10 * time.Minute},
+		{"-5m", time.Hour},
+		{"soon", time.Hour},
+	} {
+		t.Setenv("TEST_CACHE_TTL", tc.value)
+		if got := envCacheTTL("TEST_CACHE_TTL", time.Hour); got != tc.want {
+			t.Fatalf("%q: expected %v, got %v", tc.value, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// motionWindow is how far back vehicle positions are kept to estimate speed
+	motionWindow = 5 * time.Minute
+	// minMotionSpan is the shortest stretch of samples a speed is estimated
+	// from; BusTime timestamps only have minute resolution
+	minMotionSpan = 30 * time.Second
+
+	// stationaryToleranceFeet absorbs GPS jitter: a bus reporting within this
+	// distance of where it stopped hasn't moved
+	stationaryToleranceFeet = 100
+	// A move of at least minJumpFeet between two reports, faster than
+	// maxPlausibleSpeedMPH even allowing a minute of timestamp resolution, is
+	// a jump in the reported position rather than driving
+	minJumpFeet          = 2640
+	maxPlausibleSpeedMPH = 60
+
+	earthRadiusFeet     = 20902231.0
+	feetPerSecondPerMPH = 5280.0 / 3600.0
+)
+
+// motionSample is a vehicle's position along its pattern at a CTA timestamp.
+// hasPosition is false when the latitude or longitude couldn't be parsed.
+type motionSample struct {
+	patternID   string
+	pdist       int
+	lat, lon    float64
+	hasPosition bool
+	at          time.Time
+}
+
+// positionJump is a move between two consecutive reports too far and too
+// fast for the bus to have driven it.
+type positionJump struct {
+	FromLatitude  float64   `json:"fromLatitude"`
+	FromLongitude float64   `json:"fromLongitude"`
+	ToLatitude    float64   `json:"toLatitude"`
+	ToLongitude   float64   `json:"toLongitude"`
+	DistanceFeet  int       `json:"distanceFeet"`
+	Seconds       int       `json:"seconds"`
+	At            time.Time `json:"at"`
+}
+
+// vehicleMotion is what the tracker knows about one vehicle: its samples
+// within motionWindow, where and since when it has been at rest, and the
+// last time its position jumped.
+type vehicleMotion struct {
+	samples      []motionSample
+	restLat      float64
+	restLon      float64
+	restingSince time.Time
+	jump         *positionJump
+}
+
+// motionTracker keeps the recent pattern positions of every vehicle fetched
+// from BusTime, so speeds can be estimated from how far buses actually
+// travelled rather than from a single reading, and buses that stop moving
+// or jump around can be spotted.
+type motionTracker struct {
+	mu       sync.Mutex
+	vehicles map[string]*vehicleMotion
+}
+
+func newMotionTracker() *motionTracker {
+	return &motionTracker{vehicles: make(map[string]*vehicleMotion)}
+}
+
+// observe records the vehicles' positions. Repeated CTA timestamps are
+// ignored, and samples older than motionWindow are dropped.
+func (m *motionTracker) observe(vehicles []vehicle) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var newest time.Time
+	for _, v := range vehicles {
+		at, err := parseCTATime(v.Timestamp)
+		if err != nil {
+			continue
+		}
+		pdist, err := strconv.Atoi(strings.TrimSpace(v.PatternDistance))
+		if err != nil {
+			continue
+		}
+		if at.After(newest) {
+			newest = at
+		}
+
+		sample := motionSample{patternID: v.PatternID, pdist: pdist, at: at}
+		lat, errLat := strconv.ParseFloat(strings.TrimSpace(v.Latitude), 64)
+		lon, errLon := strconv.ParseFloat(strings.TrimSpace(v.Longitude), 64)
+		if errLat == nil && errLon == nil {
+			sample.lat, sample.lon, sample.hasPosition = lat, lon, true
+		}
+
+		motion, ok := m.vehicles[v.VehicleID]
+		if !ok {
+			motion = &vehicleMotion{}
+			m.vehicles[v.VehicleID] = motion
+		}
+		if n := len(motion.samples); n > 0 {
+			last := motion.samples[n-1]
+			if !at.After(last.at) {
+				continue
+			}
+			if jump, ok := detectJump(last, sample); ok {
+				motion.jump = &jump
+			}
+		}
+		if sample.hasPosition && (motion.restingSince.IsZero() || distanceFeet(motion.restLat, motion.restLon, lat, lon) > stationaryToleranceFeet) {
+			motion.restLat, motion.restLon, motion.restingSince = lat, lon, at
+		}
+		motion.samples = trimSamples(append(motion.samples, sample), at.Add(-motionWindow))
+	}
+
+	// Forget vehicles that haven't reported within the window
+	if !newest.IsZero() {
+		cutoff := newest.Add(-motionWindow)
+		for vid, motion := range m.vehicles {
+			if motion.samples[len(motion.samples)-1].at.Before(cutoff) {
+				delete(m.vehicles, vid)
+			}
+		}
+	}
+}
+
+func trimSamples(samples []motionSample, cutoff time.Time) []motionSample {
+	i := 0
+	for i < len(samples)-1 && samples[i].at.Before(cutoff) {
+		i++
+	}
+	return samples[i:]
+}
+
+// detectJump reports whether the move between two consecutive samples is
+// too far and too fast to have been driven.
+func detectJump(from motionSample, to motionSample) (positionJump, bool) {
+	if !from.hasPosition || !to.hasPosition {
+		return positionJump{}, false
+	}
+	feet := distanceFeet(from.lat, from.lon, to.lat, to.lon)
+	elapsed := to.at.Sub(from.at)
+	if feet < minJumpFeet || feet/(elapsed+time.Minute).Seconds() <= maxPlausibleSpeedMPH*feetPerSecondPerMPH {
+		return positionJump{}, false
+	}
+	return positionJump{
+		FromLatitude:  from.lat,
+		FromLongitude: from.lon,
+		ToLatitude:    to.lat,
+		ToLongitude:   to.lon,
+		DistanceFeet:  int(math.Round(feet)),
+		Seconds:       int(elapsed.Seconds()),
+		At:            to.at,
+	}, true
+}
+
+// speed returns the vehicle's average speed in feet per second over its
+// samples on its current pattern. ok is false until the samples span at
+// least minMotionSpan, or if the bus went backwards along the pattern.
+func (m *motionTracker) speed(vehicleID string) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	motion, ok := m.vehicles[vehicleID]
+	if !ok || len(motion.samples) < 2 {
+		return 0, false
+	}
+	samples := motion.samples
+	last := samples[len(samples)-1]
+	first := last
+	for i := len(samples) - 2; i >= 0 && samples[i].patternID == last.patternID; i-- {
+		first = samples[i]
+	}
+
+	elapsed := last.at.Sub(first.at)
+	if elapsed < minMotionSpan || last.pdist < first.pdist {
+		return 0, false
+	}
+	return float64(last.pdist-first.pdist) / elapsed.Seconds(), true
+}
+
+// recentJump returns the vehicle's last position jump if it happened within
+// motionWindow of its latest report.
+func (m *motionTracker) recentJump(vehicleID string) (positionJump, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	motion, ok := m.vehicles[vehicleID]
+	if !ok || motion.jump == nil {
+		return positionJump{}, false
+	}
+	if motion.samples[len(motion.samples)-1].at.Sub(motion.jump.At) > motionWindow {
+		return positionJump{}, false
+	}
+	return *motion.jump, true
+}
+
+// tag sets each vehicle's DataAgeSeconds, how old its CTA timestamp is at
+// now, and StationarySeconds, how long it had been reporting the same
+// position as of its latest report.
+func (m *motionTracker) tag(vehicles []vehicle, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range vehicles {
+		v := &vehicles[i]
+		at, err := parseCTATime(v.Timestamp)
+		if err != nil {
+			continue
+		}
+		age, stationary := 0, 0
+		if d := now.Sub(at); d > 0 {
+			age = int(d.Seconds())
+		}
+		if motion, ok := m.vehicles[v.VehicleID]; ok && !motion.restingSince.IsZero() {
+			last := motion.samples[len(motion.samples)-1]
+			stationary = int(last.at.Sub(motion.restingSince).Seconds())
+		}
+		v.DataAgeSeconds, v.StationarySeconds = &age, &stationary
+	}
+}
+
+// distanceFeet is the great-circle distance between two points.
+func distanceFeet(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusFeet * math.Asin(math.Sqrt(a))
+}
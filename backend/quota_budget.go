@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dailyBudgetEnv     = "CTA_DAILY_BUDGET"
+	budgetSoftLimitEnv = "CTA_BUDGET_SOFT_LIMITS"
+)
+
+// defaultBudgetSoftLimits are the fractions of the daily budget at which
+// polling slows down; each one crossed doubles the poll interval.
+var defaultBudgetSoftLimits = []float64{0.75, 0.9}
+
+// QuotaBudget enforces a daily limit on upstream calls for one tracked API.
+// Days roll over at UTC midnight, matching how the tracker buckets calls by
+// day.
+//
+// CTA counts every request against the key, so calls are counted as they are
+// attempted, retries and failures included. The tracker's call log only
+// records successful calls, so GetCountToday would under-count; attempts are
+// kept in their own api_budget_usage counter instead, with the call log as a
+// floor. Attempts are counted in memory and written by the Start goroutine,
+// so upstream calls never wait on the database.
+type QuotaBudget struct {
+	tracker    *APICallTracker
+	api        string
+	limit      int64
+	softLimits []float64
+	logger     *slog.Logger
+
+	mu   sync.Mutex
+	day  string
+	used int64
+	// unsaved holds the attempts not yet written, by day
+	unsaved map[string]int64
+	saveDue chan struct{}
+	// saveMu keeps flushes in order
+	saveMu sync.Mutex
+}
+
+// budgetStatus is the budget as reported by /api/tracking/counts.
+type budgetStatus struct {
+	Limit                 int64      `json:"limit"`
+	Used                  int64      `json:"used"`
+	Remaining             int64      `json:"remaining"`
+	PollSlowdown          int        `json:"pollSlowdown"`
+	Exhausted             bool       `json:"exhausted"`
+	ResetsAt              time.Time  `json:"resetsAt"`
+	ProjectedExhaustionAt *time.Time `json:"projectedExhaustionAt,omitempty"`
+}
+
+func NewQuotaBudget(tracker *APICallTracker, api string, limit int64, softLimits []float64, logger *slog.Logger) *QuotaBudget {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if len(softLimits) == 0 {
+		softLimits = defaultBudgetSoftLimits
+	}
+	limits := append([]float64(nil), softLimits...)
+	sort.Float64s(limits)
+	return &QuotaBudget{
+		tracker:    tracker,
+		api:        api,
+		limit:      limit,
+		softLimits: limits,
+		logger:     logger,
+		unsaved:    make(map[string]int64),
+		saveDue:    make(chan struct{}, 1),
+	}
+}
+
+// Start writes counted attempts to the tracker until ctx is cancelled, then
+// writes whatever is left.
+func (b *QuotaBudget) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				b.flush()
+				return
+			case <-b.saveDue:
+				b.flush()
+			}
+		}
+	}()
+}
+
+// flush writes the attempts counted since the last flush. Attempts that
+// fail to write are kept for the next one.
+func (b *QuotaBudget) flush() {
+	if b.tracker == nil {
+		return
+	}
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+
+	b.mu.Lock()
+	unsaved := b.unsaved
+	b.unsaved = make(map[string]int64)
+	b.mu.Unlock()
+
+	for day, n := range unsaved {
+		if err := b.tracker.AddBudgetUsage(b.api, day, n); err != nil {
+			b.logger.Error("failed to persist API budget usage", "api", b.api, "error", err)
+			b.mu.Lock()
+			b.unsaved[day] += n
+			b.mu.Unlock()
+		}
+	}
+}
+
+// reserve counts one upstream call against today's budget, or returns a 503
+// apiError without counting it once the budget is spent.
+func (b *QuotaBudget) reserve() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().UTC()
+	b.rolloverLocked(now)
+	if b.used >= b.limit {
+		return newBudgetExhaustedError(b.limit, nextUTCMidnight(now))
+	}
+
+	before := b.slowdownLocked()
+	b.used++
+	b.unsaved[b.day]++
+	select {
+	case b.saveDue <- struct{}{}:
+	default:
+	}
+	if after := b.slowdownLocked(); after != before {
+		b.logger.Warn("CTA API budget soft limit crossed; slowing polling", "api", b.api, "used", b.used, "limit", b.limit, "pollSlowdown", after)
+	}
+	if b.used == b.limit {
+		b.logger.Warn("CTA API daily budget exhausted; serving cached data until reset", "api", b.api, "limit", b.limit, "resetsAt", nextUTCMidnight(now))
+	}
+	return nil
+}
+
+// Exhausted reports whether today's budget is spent.
+func (b *QuotaBudget) Exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rolloverLocked(time.Now().UTC())
+	return b.used >= b.limit
+}
+
+// PollSlowdown returns the factor background polling should stretch its
+// interval by: 1 below the first soft limit, doubling for each one crossed.
+func (b *QuotaBudget) PollSlowdown() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rolloverLocked(time.Now().UTC())
+	return b.slowdownLocked()
+}
+
+// Status returns the remaining budget and, from today's average call rate,
+// when it is projected to run out.
+func (b *QuotaBudget) Status() budgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().UTC()
+	b.rolloverLocked(now)
+
+	status := budgetStatus{
+		Limit:        b.limit,
+		Used:         b.used,
+		Remaining:    max(b.limit-b.used, 0),
+		PollSlowdown: b.slowdownLocked(),
+		Exhausted:    b.used >= b.limit,
+		ResetsAt:     nextUTCMidnight(now),
+	}
+
+	elapsed := now.Sub(now.Truncate(24 * time.Hour))
+	if b.used > 0 && elapsed > 0 && !status.Exhausted {
+		perCall := elapsed / time.Duration(b.used)
+		projected := now.Add(perCall * time.Duration(status.Remaining)).Truncate(time.Second)
+		status.ProjectedExhaustionAt = &projected
+	}
+	return status
+}
+
+func (b *QuotaBudget) slowdownLocked() int {
+	slowdown := 1
+	for _, limit := range b.softLimits {
+		if float64(b.used) >= limit*float64(b.limit) {
+			slowdown *= 2
+		}
+	}
+	return slowdown
+}
+
+// rolloverLocked resets the count when the day changes, reloading it from the
+// tracker so calls made before a restart still count. Successful calls are
+// a floor, for days that began before attempts were persisted.
+func (b *QuotaBudget) rolloverLocked(now time.Time) {
+	day := now.Format(time.DateOnly)
+	if day == b.day {
+		return
+	}
+	b.day = day
+	b.used = 0
+
+	if b.tracker == nil {
+		return
+	}
+	used, err := b.tracker.GetBudgetUsage(b.api, day)
+	if err != nil {
+		b.logger.Error("failed to load today's API budget usage", "api", b.api, "error", err)
+		return
+	}
+	tracked, err := b.tracker.GetCountTodayForAPI(b.api)
+	if err != nil {
+		b.logger.Error("failed to load today's API call count", "api", b.api, "error", err)
+		return
+	}
+	b.used = max(used, tracked)
+}
+
+func newBudgetExhaustedError(limit int64, resetsAt time.Time) *apiError {
+	err := newAPIError(http.StatusServiceUnavailable, fmt.Sprintf("daily CTA API budget of %d calls exhausted; resets at %s", limit, resetsAt.Format(time.RFC3339)), nil)
+	err.retryAfter = time.Until(resetsAt)
+	return err
+}
+
+func nextUTCMidnight(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotaBudgetSurvivesRestart(t *testing.T) {
+	tracker, err := NewAPICallTracker(filepath.Join(t.TempDir(), "api_tracker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Three attempts, of which only one succeeded and was tracked
+	budget := NewQuotaBudget(tracker, trackedAPIBusTime, 10, nil, logger)
+	for i := 0; i < 3; i++ {
+		if err := budget.reserve(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tracker.TrackCall(trackedAPIBusTime, "getvehicles"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Attempts are counted in memory and written when flushed
+	day := time.Now().UTC().Format(time.DateOnly)
+	if saved, err := tracker.GetBudgetUsage(trackedAPIBusTime, day); err != nil || saved != 0 {
+		t.Fatalf("expected nothing written before a flush, got %d (err=%v)", saved, err)
+	}
+	budget.flush()
+	if saved, err := tracker.GetBudgetUsage(trackedAPIBusTime, day); err != nil || saved != 3 {
+		t.Fatalf("expected 3 attempts written, got %d (err=%v)", saved, err)
+	}
+
+	restarted := NewQuotaBudget(tracker, trackedAPIBusTime, 10, nil, logger)
+	if used := restarted.Status().Used; used != 3 {
+		t.Fatalf("expected 3 calls used after a restart, got %d", used)
+	}
+
+	// Tracked calls from before attempts were persisted still count
+	for i := 0; i < 5; i++ {
+		if err := tracker.TrackCall(trackedAPIBusTime, "getvehicles"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if used := NewQuotaBudget(tracker, trackedAPIBusTime, 10, nil, logger).Status().Used; used != 6 {
+		t.Fatalf("expected the 6 tracked calls as a floor, got %d", used)
+	}
+}
+
+func TestQuotaBudgetWritesInTheBackground(t *testing.T) {
+	tracker, err := NewAPICallTracker(filepath.Join(t.TempDir(), "api_tracker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	budget := NewQuotaBudget(tracker, trackedAPIBusTime, 10, nil, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	budget.Start(ctx)
+	for i := 0; i < 4; i++ {
+		if err := budget.reserve(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	day := time.Now().UTC().Format(time.DateOnly)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		saved, err := tracker.GetBudgetUsage(trackedAPIBusTime, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 4 attempts written, got %d", saved)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	replayDirEnv   = "CTA_REPLAY_DIR"
+	replaySpeedEnv = "CTA_REPLAY_SPEED"
+	// replayAPIKey stands in for CTA_API_KEY, which replay mode doesn't need
+	replayAPIKey = "replay"
+	// replayLoopPause is how long (in capture time) the last recording is
+	// served before playback starts over
+	replayLoopPause = time.Minute
+)
+
+// replayClock maps wall-clock time onto a capture's timeline. Playback starts
+// at the first recording when the clock is created, runs at speed and loops
+// back to the start after the last recording.
+type replayClock struct {
+	start     time.Time
+	end       time.Time
+	speed     float64
+	realStart time.Time
+	now       func() time.Time
+}
+
+func newReplayClock(start time.Time, end time.Time, speed float64, now func() time.Time) *replayClock {
+	if now == nil {
+		now = time.Now
+	}
+	return &replayClock{start: start, end: end, speed: speed, realStart: now(), now: now}
+}
+
+// Now returns the current position in the capture.
+func (c *replayClock) Now() time.Time {
+	elapsed := time.Duration(float64(c.now().Sub(c.realStart)) * c.speed)
+	return c.start.Add(elapsed % (c.end.Sub(c.start) + replayLoopPause))
+}
+
+// live moves the capture time t to the wall clock, keeping its age relative
+// to the playback position, so replayed data is exactly as stale as it was
+// when recorded.
+func (c *replayClock) live(t time.Time) time.Time {
+	return c.now().Add(-c.Now().Sub(t))
+}
+
+// replayVehicles is what one recorded getvehicles response said about a route.
+type replayVehicles struct {
+	at       time.Time
+	vehicles []map[string]interface{}
+}
+
+// replayTransport is an http.RoundTripper that answers BusTime requests from
+// a capture directory instead of the network. Each request is answered with
+// the latest recording made at or before the clock's current time (or the
+// first recording, for data captured only after playback starts).
+//
+// getvehicles is answered per route rather than per request, so the routes
+// requested don't have to be batched the way they were when recorded, and
+// vehicle timestamps are shifted so their age matches the recording.
+// getpatterns by pid is answered per pattern the same way; patterns that
+// were never recorded get BusTime's "No data found" error.
+type replayTransport struct {
+	clock     *replayClock
+	responses map[string][]captureEntry
+	vehicles  map[string][]replayVehicles
+	patterns  map[string]json.RawMessage
+}
+
+// newReplayTransport loads a capture directory written by captureTransport
+// and/or JSON files saved from /api/history/vehicles, which are replayed as
+// getvehicles responses.
+func newReplayTransport(dir string, speed float64, now func() time.Time) (*replayTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	t := &replayTransport{
+		responses: make(map[string][]captureEntry),
+		vehicles:  make(map[string][]replayVehicles),
+		patterns:  make(map[string]json.RawMessage),
+	}
+	var start, end time.Time
+	span := func(at time.Time) {
+		if start.IsZero() || at.Before(start) {
+			start = at
+		}
+		if at.After(end) {
+			end = at
+		}
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var probe struct {
+			Frames json.RawMessage `json:"frames"`
+		}
+		if err := json.Unmarshal(data, &probe); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		if probe.Frames != nil {
+			var playback playbackResult
+			if err := json.Unmarshal(data, &playback); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			for _, frame := range playback.Frames {
+				span(frame.Time)
+			}
+			t.addFrames(playback)
+			continue
+		}
+
+		var entry captureEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if entry.Endpoint == "" || entry.RecordedAt.IsZero() {
+			return nil, fmt.Errorf("%s: not a BusTime capture or history playback file", file)
+		}
+		span(entry.RecordedAt)
+		if entry.Endpoint == ctaGetVehicles {
+			if err := t.addVehicles(entry); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			continue
+		}
+		if entry.Endpoint == ctaGetPatterns {
+			if err := t.addPatterns(entry); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+		}
+		key := entry.Endpoint + "?" + entry.Query
+		t.responses[key] = append(t.responses[key], entry)
+	}
+
+	if start.IsZero() {
+		return nil, fmt.Errorf("no recordings found in %s", dir)
+	}
+	if _, ok := t.responses[ctaGetRoutes+"?"]; !ok {
+		t.responses[ctaGetRoutes+"?"] = []captureEntry{t.syntheticRoutes(start)}
+	}
+	for key := range t.responses {
+		entries := t.responses[key]
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].RecordedAt.Before(entries[j].RecordedAt) })
+	}
+	for rt := range t.vehicles {
+		points := t.vehicles[rt]
+		sort.SliceStable(points, func(i, j int) bool { return points[i].at.Before(points[j].at) })
+	}
+
+	t.clock = newReplayClock(start, end, speed, now)
+	return t, nil
+}
+
+// addVehicles indexes a recorded getvehicles response by each requested
+// route, including the routes that had no vehicles.
+func (t *replayTransport) addVehicles(entry captureEntry) error {
+	if entry.Status != http.StatusOK {
+		return nil
+	}
+	var resp struct {
+		BustimeResponse struct {
+			Vehicles []map[string]interface{} `json:"vehicle"`
+		} `json:"bustime-response"`
+	}
+	if err := json.Unmarshal(entry.Body, &resp); err != nil {
+		return err
+	}
+	query, err := url.ParseQuery(entry.Query)
+	if err != nil {
+		return err
+	}
+
+	byRoute := make(map[string][]map[string]interface{})
+	for _, v := range resp.BustimeResponse.Vehicles {
+		rt := fmt.Sprint(v["rt"])
+		byRoute[rt] = append(byRoute[rt], v)
+	}
+	for _, rt := range splitIdentifiers(query.Get("rt")) {
+		t.vehicles[rt] = append(t.vehicles[rt], replayVehicles{at: entry.RecordedAt, vehicles: byRoute[rt]})
+	}
+	return nil
+}
+
+// addPatterns indexes the patterns in a recorded getpatterns response by
+// pattern ID. Patterns don't change during a session, so the last recording
+// of each wins.
+func (t *replayTransport) addPatterns(entry captureEntry) error {
+	if entry.Status != http.StatusOK {
+		return nil
+	}
+	var resp struct {
+		BustimeResponse struct {
+			Patterns []json.RawMessage `json:"ptr"`
+		} `json:"bustime-response"`
+	}
+	if err := json.Unmarshal(entry.Body, &resp); err != nil {
+		return err
+	}
+	for _, raw := range resp.BustimeResponse.Patterns {
+		var p struct {
+			Pid interface{} `json:"pid"`
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return err
+		}
+		t.patterns[fmt.Sprint(p.Pid)] = raw
+	}
+	return nil
+}
+
+// addFrames indexes history playback frames as if each frame had been a
+// getvehicles response for every route in the file.
+func (t *replayTransport) addFrames(playback playbackResult) {
+	routes := make(map[string]bool)
+	for _, rt := range playback.Routes {
+		routes[rt] = true
+	}
+	for _, frame := range playback.Frames {
+		for _, v := range frame.Vehicles {
+			routes[v.Route] = true
+		}
+	}
+
+	for _, frame := range playback.Frames {
+		byRoute := make(map[string][]map[string]interface{})
+		for _, v := range frame.Vehicles {
+			byRoute[v.Route] = append(byRoute[v.Route], map[string]interface{}{
+				"vid":    v.VehicleID,
+				"tmstmp": frame.Time.In(chicagoLocation).Format("20060102 15:04:05"),
+				"lat":    strconv.FormatFloat(v.Latitude, 'f', -1, 64),
+				"lon":    strconv.FormatFloat(v.Longitude, 'f', -1, 64),
+				"hdg":    strconv.Itoa(v.Heading),
+				"pid":    v.PatternID,
+				"pdist":  v.PatternDistance,
+				"rt":     v.Route,
+				"des":    "",
+				"dly":    v.Delayed,
+			})
+		}
+		for rt := range routes {
+			t.vehicles[rt] = append(t.vehicles[rt], replayVehicles{at: frame.Time, vehicles: byRoute[rt]})
+		}
+	}
+}
+
+// syntheticRoutes builds a getroutes response from the routes seen in
+// getvehicles recordings, for captures that don't include one.
+func (t *replayTransport) syntheticRoutes(at time.Time) captureEntry {
+	routes := make([]map[string]string, 0, len(t.vehicles))
+	for rt := range t.vehicles {
+		routes = append(routes, map[string]string{"rt": rt, "rtnm": rt, "rtclr": "#565a5c", "rtdd": rt})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i]["rt"] < routes[j]["rt"] })
+	body, _ := json.Marshal(map[string]interface{}{"bustime-response": map[string]interface{}{"routes": routes}})
+	return captureEntry{RecordedAt: at, Endpoint: ctaGetRoutes, Status: http.StatusOK, Body: body}
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := path.Base(req.URL.Path)
+	now := t.clock.Now()
+
+	if endpoint == ctaGetVehicles {
+		return replayResponse(req, http.StatusOK, t.vehiclesAt(splitIdentifiers(req.URL.Query().Get("rt")), now)), nil
+	}
+	if pids := splitIdentifiers(req.URL.Query().Get("pid")); endpoint == ctaGetPatterns && len(pids) > 0 {
+		return replayResponse(req, http.StatusOK, t.patternsFor(pids)), nil
+	}
+
+	query := captureQuery(req.URL.Query())
+	entries := t.responses[endpoint+"?"+query]
+	if len(entries) == 0 {
+		return replayResponse(req, http.StatusNotFound, []byte(fmt.Sprintf("no %s response for %q in the replay capture", endpoint, query))), nil
+	}
+	entry := entries[0]
+	for _, e := range entries {
+		if e.RecordedAt.After(now) {
+			break
+		}
+		entry = e
+	}
+	return replayResponse(req, entry.Status, entry.body()), nil
+}
+
+// vehiclesAt builds a getvehicles response for routes as of now. Like the
+// live API, routes without vehicles are reported as "No data found" errors.
+func (t *replayTransport) vehiclesAt(routes []string, now time.Time) []byte {
+	vehicles := make([]map[string]interface{}, 0)
+	errs := make([]map[string]string, 0)
+	for _, rt := range routes {
+		points := t.vehicles[rt]
+		next := sort.Search(len(points), func(i int) bool { return points[i].at.After(now) })
+		if next == 0 || len(points[next-1].vehicles) == 0 {
+			errs = append(errs, map[string]string{"rt": rt, "msg": "No data found for parameter"})
+			continue
+		}
+		for _, recorded := range points[next-1].vehicles {
+			vehicles = append(vehicles, t.shiftTimestamps(recorded))
+		}
+	}
+
+	payload := make(map[string]interface{})
+	if len(vehicles) > 0 {
+		payload["vehicle"] = vehicles
+	}
+	if len(errs) > 0 {
+		payload["error"] = errs
+	}
+	body, _ := json.Marshal(map[string]interface{}{"bustime-response": payload})
+	return body
+}
+
+// patternsFor builds a getpatterns response for pattern IDs. History
+// playback files don't include patterns, so a capture built only from them
+// reports every pattern as "No data found" and its vehicles' directions as
+// unknown.
+func (t *replayTransport) patternsFor(pids []string) []byte {
+	patterns := make([]json.RawMessage, 0, len(pids))
+	errs := make([]map[string]string, 0)
+	for _, pid := range pids {
+		if raw, ok := t.patterns[pid]; ok {
+			patterns = append(patterns, raw)
+			continue
+		}
+		errs = append(errs, map[string]string{"pid": pid, "msg": "No data found for parameter"})
+	}
+
+	payload := make(map[string]interface{})
+	if len(patterns) > 0 {
+		payload["ptr"] = patterns
+	}
+	if len(errs) > 0 {
+		payload["error"] = errs
+	}
+	body, _ := json.Marshal(map[string]interface{}{"bustime-response": payload})
+	return body
+}
+
+// shiftTimestamps returns a copy of a recorded vehicle with tmstmp and
+// srvtmstmp moved from capture time to the wall clock.
+func (t *replayTransport) shiftTimestamps(recorded map[string]interface{}) map[string]interface{} {
+	v := make(map[string]interface{}, len(recorded))
+	for key, value := range recorded {
+		v[key] = value
+	}
+	for _, key := range []string{"tmstmp", "srvtmstmp"} {
+		raw, ok := v[key].(string)
+		if !ok {
+			continue
+		}
+		at, err := parseCTATime(raw)
+		if err != nil {
+			continue
+		}
+		layout := "20060102 15:04"
+		if len(strings.TrimSpace(raw)) > len(layout) {
+			layout = "20060102 15:04:05"
+		}
+		v[key] = t.clock.live(at).In(chicagoLocation).Format(layout)
+	}
+	return v
+}
+
+func replayResponse(req *http.Request, status int, body []byte) *http.Response {
+	contentType := "text/plain; charset=utf-8"
+	if json.Valid(body) {
+		contentType = "application/json"
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
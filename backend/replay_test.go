@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a wall clock the test moves by hand.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestReplayClock(t *testing.T) {
+	wall := &fakeClock{now: time.Date(2026, 1, 5, 12, 0, 0, 0, chicagoLocation)}
+	start := time.Date(2024, 6, 12, 8, 0, 0, 0, chicagoLocation)
+	clock := newReplayClock(start, start.Add(10*time.Minute), 2, wall.Now)
+
+	for _, tc := range []struct {
+		elapsed time.Duration
+		want    time.Time
+	}{
+		{0, start},
+		{3 * time.Minute, start.Add(6 * time.Minute)},
+		// The last recording is held for replayLoopPause before looping
+		{5*time.Minute + 15*time.Second, start.Add(10*time.Minute + 30*time.Second)},
+		{6 * time.Minute, start.Add(time.Minute)},
+	} {
+		wall.now = clock.realStart.Add(tc.elapsed)
+		if got := clock.Now(); !got.Equal(tc.want) {
+			t.Fatalf("after %s: expected %s, got %s", tc.elapsed, tc.want, got)
+		}
+	}
+
+	// Data a minute old in capture time is a minute old on the wall clock
+	wall.now = clock.realStart.Add(3 * time.Minute)
+	if got, want := clock.live(start.Add(5*time.Minute)), wall.now.Add(-time.Minute); !got.Equal(want) {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestReplayTransport(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 6, 12, 8, 0, 0, 0, chicagoLocation)
+	writeJSON := func(name string, v interface{}) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeJSON("1.json", captureEntry{
+		RecordedAt: start, Endpoint: ctaGetVehicles, Query: "rt=9%2C22", Status: http.StatusOK,
+		Body: json.RawMessage(`{"bustime-response":{"vehicle":[{"vid":"1311","rt":"9","tmstmp":"20240612 08:00"}]}}`),
+	})
+	writeJSON("2.json", captureEntry{
+		RecordedAt: start.Add(2 * time.Minute), Endpoint: ctaGetVehicles, Query: "rt=9", Status: http.StatusOK,
+		Body: json.RawMessage(`{"bustime-response":{"vehicle":[{"vid":"1311","rt":"9","tmstmp":"20240612 08:02","srvtmstmp":"20240612 08:02:15"}]}}`),
+	})
+	writeJSON("3.json", captureEntry{
+		RecordedAt: start, Endpoint: ctaGetPatterns, Query: "pid=5425", Status: http.StatusOK,
+		Body: json.RawMessage(`{"bustime-response":{"ptr":[{"pid":5425,"rtdir":"Southbound","pt":[]}]}}`),
+	})
+	writeJSON("4.json", playbackResult{
+		Routes: []string{"66"},
+		Frames: []playbackFrame{{
+			Time:     start.Add(time.Minute),
+			Vehicles: []playbackVehicle{{VehicleID: "8012", Route: "66", PatternID: "3932", Heading: 90}},
+		}},
+	})
+
+	wall := &fakeClock{now: time.Date(2026, 1, 5, 12, 0, 0, 0, chicagoLocation)}
+	transport, err := newReplayTransport(dir, 1, wall.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string) string {
+		req, err := http.NewRequest(http.MethodGet, "http://replay/bustime/api/v3/"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body json.RawMessage
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	// Each route is answered from its own latest recording, whatever the
+	// batches were when recorded
+	for _, tc := range []struct {
+		elapsed time.Duration
+		want    string
+	}{
+		{0, `{"bustime-response":{"error":[{"msg":"No data found for parameter","rt":"22"},{"msg":"No data found for parameter","rt":"66"}],"vehicle":[{"rt":"9","tmstmp":"20260105 12:00","vid":"1311"}]}}`},
+		{150 * time.Second, `{"bustime-response":{"error":[{"msg":"No data found for parameter","rt":"22"}],"vehicle":[{"rt":"9","srvtmstmp":"20260105 12:02:15","tmstmp":"20260105 12:02","vid":"1311"},{"des":"","dly":false,"hdg":"90","lat":"0","lon":"0","pdist":0,"pid":"3932","rt":"66","tmstmp":"20260105 12:01:00","vid":"8012"}]}}`},
+	} {
+		wall.now = transport.clock.realStart.Add(tc.elapsed)
+		if got := get("getvehicles?key=replay&format=json&rt=9,22,66"); got != tc.want {
+			t.Fatalf("after %s: expected %s, got %s", tc.elapsed, tc.want, got)
+		}
+	}
+
+	// Patterns are answered per pattern too; ones only seen in history
+	// frames have no data
+	got := get("getpatterns?key=replay&format=json&pid=3932,5425")
+	if want := `{"bustime-response":{"error":[{"msg":"No data found for parameter","pid":"3932"}],"ptr":[{"pid":5425,"rtdir":"Southbound","pt":[]}]}}`; got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	// The route list is synthesized from the recorded routes
+	if got := get("getroutes?key=replay&format=json"); !strings.Contains(got, `"rt":"22"`) || !strings.Contains(got, `"rt":"66"`) || !strings.Contains(got, `"rt":"9"`) {
+		t.Fatalf("expected every recorded route, got %s", got)
+	}
+}
+
+func TestShiftTimestamps(t *testing.T) {
+	wall := &fakeClock{now: time.Date(2026, 1, 5, 12, 0, 0, 0, chicagoLocation)}
+	start := time.Date(2024, 6, 12, 8, 0, 0, 0, chicagoLocation)
+	transport := &replayTransport{clock: newReplayClock(start, start.Add(time.Hour), 1, wall.Now)}
+	wall.now = wall.now.Add(5 * time.Minute)
+
+	recorded := map[string]interface{}{"vid": "1311", "tmstmp": "20240612 08:03", "srvtmstmp": "20240612 08:04:30", "stst": 30600}
+	shifted := transport.shiftTimestamps(recorded)
+	if shifted["tmstmp"] != "20260105 12:03" || shifted["srvtmstmp"] != "20260105 12:04:30" || shifted["stst"] != 30600 || shifted["vid"] != "1311" {
+		t.Fatalf("unexpected shifted vehicle %v", shifted)
+	}
+	if recorded["tmstmp"] != "20240612 08:03" {
+		t.Fatal("expected the recording to be left unchanged")
+	}
+
+	// Timestamps that don't parse are passed through
+	if shifted := transport.shiftTimestamps(map[string]interface{}{"tmstmp": "soon"}); shifted["tmstmp"] != "soon" {
+		t.Fatalf("unexpected shifted vehicle %v", shifted)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	routeCacheTTLEnv          = "ROUTE_CACHE_TTL"
+	routeCacheMaxStaleEnv     = "ROUTE_CACHE_MAX_STALE"
+	defaultRouteCacheTTL      = time.Hour
+	defaultRouteCacheMaxStale = 24 * time.Hour
+)
+
+// routeCache holds the BusTime route list in memory. Within ttl the cached
+// list is served as is; for maxStale past that it is still served while a
+// single background request refreshes it; after that callers wait for a
+// fresh list. Concurrent misses share one in-flight upstream request.
+type routeCache struct {
+	ttl      time.Duration
+	maxStale time.Duration
+
+	mu        sync.Mutex
+	routes    []route
+	fetchedAt time.Time
+	inflight  *routeFetch
+}
+
+// routeFetch is an upstream getroutes request that several callers may wait on.
+type routeFetch struct {
+	done   chan struct{}
+	routes []route
+	err    error
+}
+
+func newRouteCache(ttl time.Duration, maxStale time.Duration) *routeCache {
+	return &routeCache{ttl: ttl, maxStale: maxStale}
+}
+
+// get returns the cached routes, calling load when they are missing or too
+// stale; if the daily budget or circuit breaker refuses the refresh, routes
+// of any age are served instead. load runs detached from any single caller's
+// context so one caller giving up does not fail the others waiting on the
+// same request.
+func (c *routeCache) get(ctx context.Context, load func(context.Context) ([]route, error)) ([]route, error) {
+	c.mu.Lock()
+	hasRoutes := c.routes != nil
+	age := time.Since(c.fetchedAt)
+
+	if hasRoutes && age < c.ttl {
+		routes := copyRoutes(c.routes)
+		c.mu.Unlock()
+		return routes, nil
+	}
+
+	if hasRoutes && age < c.ttl+c.maxStale {
+		routes := copyRoutes(c.routes)
+		c.startFetchLocked(load)
+		c.mu.Unlock()
+		return routes, nil
+	}
+
+	stale := c.routes
+	fetch := c.startFetchLocked(load)
+	c.mu.Unlock()
+
+	select {
+	case <-fetch.done:
+		if fetch.err != nil {
+			if stale != nil && isUpstreamRefused(fetch.err) {
+				return copyRoutes(stale), nil
+			}
+			return nil, fetch.err
+		}
+		return copyRoutes(fetch.routes), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// startFetchLocked joins the in-flight request or starts a new one. c.mu must be held.
+func (c *routeCache) startFetchLocked(load func(context.Context) ([]route, error)) *routeFetch {
+	if c.inflight != nil {
+		return c.inflight
+	}
+
+	fetch := &routeFetch{done: make(chan struct{})}
+	c.inflight = fetch
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultHTTPTimeout)
+		defer cancel()
+
+		routes, err := load(ctx)
+
+		c.mu.Lock()
+		if err == nil {
+			c.routes = routes
+			c.fetchedAt = time.Now()
+		}
+		c.inflight = nil
+		c.mu.Unlock()
+
+		fetch.routes, fetch.err = routes, err
+		close(fetch.done)
+	}()
+	return fetch
+}
+
+// copyRoutes returns a copy callers may modify (e.g. to set HasBulletins)
+// without touching the cached list.
+func copyRoutes(routes []route) []route {
+	out := make([]route, len(routes))
+	copy(out, routes)
+	return out
+}
@@ -0,0 +1,198 @@
+// Command import_l_stations loads the CTA "List of 'L' Stops" CSV into the
+// l_stations table of the catalog database, one row per parent station.
+//
+//	go run ./scripts/import_l_stations data/<file_name>.csv
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// lineColumns maps the CSV line flag columns to Train Tracker line codes.
+// Purple Line Express stops are reported as Purple.
+var lineColumns = []struct {
+	column string
+	code   string
+}{
+	{"RED", "red"},
+	{"BLUE", "blue"},
+	{"BRN", "brn"},
+	{"G", "g"},
+	{"O", "org"},
+	{"P", "p"},
+	{"Pexp", "p"},
+	{"Pnk", "pink"},
+	{"Y", "y"},
+}
+
+type station struct {
+	mapID           string
+	name            string
+	descriptiveName string
+	lines           map[string]bool
+	ada             bool
+	latitude        float64
+	longitude       float64
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal("Usage: go run ./scripts/import_l_stations <csv-file>")
+	}
+
+	csvPath := os.Args[1]
+	dbPath := os.Getenv("CATALOG_DB_PATH")
+	if dbPath == "" {
+		dbPath = filepath.Join(filepath.Dir(csvPath), "catalog.db")
+	}
+
+	file, err := os.Open(csvPath)
+	if err != nil {
+		log.Fatalf("Failed to open CSV: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		log.Fatalf("Failed to read CSV header: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"MAP_ID", "STATION_NAME", "STATION_DESCRIPTIVE_NAME", "ADA", "Location"} {
+		if _, ok := columns[required]; !ok {
+			log.Fatalf("CSV is missing column %s", required)
+		}
+	}
+
+	// The CSV has one row per platform (stop); fold them into their parent station.
+	stations := make(map[string]*station)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Warning: skipping row due to error: %v", err)
+			continue
+		}
+
+		mapID := record[columns["MAP_ID"]]
+		st, ok := stations[mapID]
+		if !ok {
+			lat, lon, err := parseLocation(record[columns["Location"]])
+			if err != nil {
+				log.Printf("Warning: skipping row with invalid location %s: %v", record[columns["Location"]], err)
+				continue
+			}
+			st = &station{
+				mapID:           mapID,
+				name:            record[columns["STATION_NAME"]],
+				descriptiveName: record[columns["STATION_DESCRIPTIVE_NAME"]],
+				lines:           make(map[string]bool),
+				latitude:        lat,
+				longitude:       lon,
+			}
+			stations[mapID] = st
+		}
+
+		st.ada = st.ada || parseFlag(record[columns["ADA"]])
+		for _, lc := range lineColumns {
+			if idx, ok := columns[lc.column]; ok && parseFlag(record[idx]) {
+				st.lines[lc.code] = true
+			}
+		}
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS l_stations (
+			map_id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			descriptive_name TEXT NOT NULL,
+			lines TEXT NOT NULL,
+			ada INTEGER NOT NULL,
+			latitude REAL NOT NULL,
+			longitude REAL NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_l_stations_name ON l_stations(name);
+	`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Failed to begin transaction: %v", err)
+	}
+
+	// Replace the whole catalog so stations removed from the CSV disappear too.
+	if _, err := tx.Exec(`DELETE FROM l_stations`); err != nil {
+		log.Fatalf("Failed to clear stations: %v", err)
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO l_stations (map_id, name, descriptive_name, lines, ada, latitude, longitude) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		log.Fatalf("Failed to prepare statement: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, st := range stations {
+		lines := make([]string, 0, len(st.lines))
+		for code := range st.lines {
+			lines = append(lines, code)
+		}
+		sort.Strings(lines)
+
+		if _, err := stmt.Exec(st.mapID, st.name, st.descriptiveName, strings.Join(lines, ","), st.ada, st.latitude, st.longitude); err != nil {
+			log.Fatalf("Failed to insert station %s: %v", st.mapID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Failed to commit transaction: %v", err)
+	}
+
+	fmt.Printf("Successfully imported %d stations\n", len(stations))
+	fmt.Printf("Catalog database: %s\n", dbPath)
+}
+
+func parseFlag(value string) bool {
+	flag, err := strconv.ParseBool(strings.TrimSpace(value))
+	return err == nil && flag
+}
+
+// parseLocation parses the dataset's "(41.875478, -87.688436)" location format.
+func parseLocation(value string) (float64, float64, error) {
+	parts := strings.Split(strings.Trim(strings.TrimSpace(value), "()"), ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected \"(lat, lon)\"")
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lat, lon, nil
+}
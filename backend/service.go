@@ -7,23 +7,45 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	_ "time/tzdata" // the runtime image has no zoneinfo; BusTime times are America/Chicago
 )
 
 const (
 	apiKeyEnv          = "CTA_API_KEY"
-	ctaGetRoutesURL    = "https://www.ctabustracker.com/bustime/api/v3/getroutes"
-	ctaGetVehiclesURL  = "https://www.ctabustracker.com/bustime/api/v3/getvehicles"
+	baseURLEnv         = "CTA_API_BASE_URL"
+	defaultCTABaseURL  = "https://www.ctabustracker.com/bustime/api/v3"
+	ctaGetRoutes       = "getroutes"
+	ctaGetVehicles     = "getvehicles"
+	ctaGetPredictions  = "getpredictions"
 	defaultHTTPTimeout = 10 * time.Second
+	// BusTime accepts at most 10 comma-separated identifiers per request.
+	maxBustimeIdentifiers = 10
+	// defaultMaxConcurrency bounds how many BusTime requests a fan-out keeps in flight.
+	defaultMaxConcurrency = 4
+	maxConcurrencyEnv     = "CTA_MAX_CONCURRENCY"
 )
 
+var chicagoLocation = mustLoadLocation("America/Chicago")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
 type apiError struct {
-	status  int
-	message string
-	payload interface{}
+	status     int
+	message    string
+	payload    interface{}
+	retryAfter time.Duration
 }
 
 func (e *apiError) Error() string {
@@ -42,16 +64,44 @@ func newAPIError(status int, message string, payload interface{}) *apiError {
 }
 
 type CTAService struct {
-	apiKey  string
-	client  *http.Client
-	logger  *slog.Logger
-	tracker *APICallTracker
+	apiKey     string
+	baseURL    string
+	client     *http.Client
+	logger     *slog.Logger
+	tracker    *APICallTracker
+	catalog    *CatalogStore
+	catalogTTL time.Duration
+
+	maxConcurrency int
+	routeCache     *routeCache
+	bulletinCache  *bulletinCache
+	budget         *QuotaBudget
+	retry          retryPolicy
+	breaker        *circuitBreaker
+	history        *HistoryStore
+
+	bunchingThreshold int
+	motion            *motionTracker
+	staleAfter        time.Duration
+	idleAfter         time.Duration
+
+	directionsMu      sync.Mutex
+	patternDirections map[string]string
 }
 
-func NewCTAService(apiKey string, client *http.Client, logger *slog.Logger, tracker *APICallTracker) (*CTAService, error) {
+// NewCTAService creates a BusTime client. baseURL is the v3 API root
+// (e.g. https://www.ctabustracker.com/bustime/api/v3); an empty value
+// falls back to the production CTA endpoint.
+func NewCTAService(apiKey string, baseURL string, client *http.Client, logger *slog.Logger, tracker *APICallTracker) (*CTAService, error) {
 	if apiKey == "" {
 		return nil, fmt.Errorf("%s is not set", apiKeyEnv)
 	}
+	if baseURL == "" {
+		baseURL = defaultCTABaseURL
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", baseURLEnv, err)
+	}
 	if client == nil {
 		client = &http.Client{Timeout: defaultHTTPTimeout}
 	}
@@ -60,12 +110,202 @@ func NewCTAService(apiKey string, client *http.Client, logger *slog.Logger, trac
 	}
 	return &CTAService{
 		apiKey:  apiKey,
+		baseURL: strings.TrimRight(baseURL, "/"),
 		client:  client,
 		logger:  logger,
 		tracker: tracker,
+
+		maxConcurrency: defaultMaxConcurrency,
+		routeCache:     newRouteCache(defaultRouteCacheTTL, defaultRouteCacheMaxStale),
+		bulletinCache:  newBulletinCache(defaultBulletinCacheTTL),
+		retry:          defaultRetryPolicy(),
+		breaker:        newCircuitBreaker(trackedAPIBusTime, defaultBreakerThreshold, defaultBreakerCooldown, logger),
+
+		bunchingThreshold: defaultBunchingThreshold,
+		motion:            newMotionTracker(),
+		staleAfter:        defaultStaleAfter,
+		idleAfter:         defaultIdleAfter,
+		patternDirections: make(map[string]string),
 	}, nil
 }
 
+// SetRouteCacheTTL configures the route list cache: routes younger than ttl
+// are served from memory, and for maxStale after that they are served while
+// being refreshed in the background. A ttl of 0 disables the cache.
+func (s *CTAService) SetRouteCacheTTL(ttl time.Duration, maxStale time.Duration) {
+	if ttl <= 0 {
+		s.routeCache = nil
+		return
+	}
+	s.routeCache = newRouteCache(ttl, maxStale)
+}
+
+// SetBulletinCacheTTL sets how long service bulletins are cached in memory.
+// A ttl of 0 disables the cache.
+func (s *CTAService) SetBulletinCacheTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		s.bulletinCache = nil
+		return
+	}
+	s.bulletinCache = newBulletinCache(ttl)
+}
+
+// SetQuotaBudget enforces a daily budget on BusTime calls. Once it is spent,
+// upstream calls fail with a 503 and cached data is served where available.
+func (s *CTAService) SetQuotaBudget(budget *QuotaBudget) {
+	s.budget = budget
+}
+
+// BudgetExhausted reports whether today's BusTime budget is spent.
+func (s *CTAService) BudgetExhausted() bool {
+	return s.budget != nil && s.budget.Exhausted()
+}
+
+// PollSlowdown returns the factor background polling should stretch its
+// interval by to stay within the daily budget.
+func (s *CTAService) PollSlowdown() int {
+	if s.budget == nil {
+		return 1
+	}
+	return s.budget.PollSlowdown()
+}
+
+// SetRetryPolicy sets how failed BusTime requests are retried.
+func (s *CTAService) SetRetryPolicy(policy retryPolicy) {
+	s.retry = policy
+}
+
+// SetCircuitBreaker replaces the BusTime circuit breaker: it opens after
+// threshold consecutive failures and probes again after cooldown.
+func (s *CTAService) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	s.breaker = newCircuitBreaker(trackedAPIBusTime, threshold, cooldown, s.logger)
+}
+
+// BreakerStatus returns the state of the BusTime circuit breaker.
+func (s *CTAService) BreakerStatus() breakerStatus {
+	return s.breaker.Status()
+}
+
+// SetHistoryStore records every vehicle fetched from BusTime to history.
+func (s *CTAService) SetHistoryStore(history *HistoryStore) {
+	s.history = history
+}
+
+// SetBunchingThreshold sets how close together, in feet along the pattern,
+// two buses have to be to count as bunched.
+func (s *CTAService) SetBunchingThreshold(feet int) {
+	s.bunchingThreshold = feet
+}
+
+// BunchingThreshold returns the distance in feet below which buses count as bunched.
+func (s *CTAService) BunchingThreshold() int {
+	return s.bunchingThreshold
+}
+
+// RecentSpeed returns how fast the vehicle has been progressing along its
+// pattern over the last few minutes, in feet per second.
+func (s *CTAService) RecentSpeed(vehicleID string) (float64, bool) {
+	return s.motion.speed(vehicleID)
+}
+
+// SetAnomalyThresholds sets how old a vehicle's data has to be to count as
+// stale, and how long it has to report the same position to count as idle.
+func (s *CTAService) SetAnomalyThresholds(staleAfter time.Duration, idleAfter time.Duration) {
+	s.staleAfter = staleAfter
+	s.idleAfter = idleAfter
+}
+
+// StaleAfter returns the data age beyond which a vehicle counts as stale.
+func (s *CTAService) StaleAfter() time.Duration {
+	return s.staleAfter
+}
+
+// IdleAfter returns how long a vehicle has to stay put to count as idle.
+func (s *CTAService) IdleAfter() time.Duration {
+	return s.idleAfter
+}
+
+// RecentJump returns the vehicle's latest implausible jump in position, if
+// it happened within the last few minutes of its reports.
+func (s *CTAService) RecentJump(vehicleID string) (positionJump, bool) {
+	return s.motion.recentJump(vehicleID)
+}
+
+// SetMaxConcurrency sets how many BusTime requests GetAllVehicles may have in
+// flight at once. Values below 1 are treated as 1.
+func (s *CTAService) SetMaxConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	s.maxConcurrency = n
+}
+
+// endpointURL returns the full URL for a BusTime endpoint such as "getroutes".
+func (s *CTAService) endpointURL(endpoint string) string {
+	return s.baseURL + "/" + endpoint
+}
+
+// fetch calls a BusTime endpoint with the given query parameters and decodes
+// the JSON body into out. Transient failures are retried per s.retry; calls
+// refused by the budget or circuit breaker are returned as 503 apiErrors, and
+// transport, status and decoding failures as 502 apiErrors. BusTime-level
+// errors are left to the caller.
+func (s *CTAService) fetch(ctx context.Context, endpoint string, params url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.endpointURL(endpoint), nil)
+	if err != nil {
+		s.logger.Error("failed to create request", "error", err)
+		return err
+	}
+
+	query := req.URL.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	query.Set("format", "json")
+	query.Set("key", s.apiKey)
+	req.URL.RawQuery = query.Encode()
+
+	resp, err := upstreamGet(ctx, s.client, req, s.retry, s.breaker, s.logger, s.reserveBudget)
+	if err != nil {
+		if apiErr, ok := err.(*apiError); ok {
+			s.logger.Warn("CTA API request refused", "endpoint", endpoint, "error", apiErr)
+			return apiErr
+		}
+		s.logger.Error("CTA API request failed", "endpoint", endpoint, "error", err)
+		return newAPIError(http.StatusBadGateway, fmt.Sprintf("CTA API request failed: %v", err), nil)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		s.logger.Error("CTA API returned non-OK status", "endpoint", endpoint, "status", resp.StatusCode, "body", string(body))
+		return newAPIError(http.StatusBadGateway, fmt.Sprintf("CTA API returned status %d: %s", resp.StatusCode, string(body)), nil)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		s.logger.Error("failed to decode CTA API response", "endpoint", endpoint, "error", err)
+		return newAPIError(http.StatusBadGateway, fmt.Sprintf("failed to decode CTA API response: %v", err), nil)
+	}
+	return nil
+}
+
+// reserveBudget charges one upstream call against the daily budget, if any.
+func (s *CTAService) reserveBudget() error {
+	if s.budget == nil {
+		return nil
+	}
+	return s.budget.reserve()
+}
+
+func (s *CTAService) trackCall(endpoint string) {
+	if s.tracker == nil {
+		return
+	}
+	if err := s.tracker.TrackCall(trackedAPIBusTime, s.endpointURL(endpoint)); err != nil {
+		s.logger.Error("failed to track API call", "error", err)
+	}
+}
+
 type ctaError struct {
 	Msg string `json:"msg"`
 }
@@ -108,6 +348,16 @@ func (f *flexibleString) UnmarshalJSON(b []byte) error {
 	return fmt.Errorf("flexibleString: unsupported value %s", string(b))
 }
 
+// parseCTATime parses BusTime timestamps ("20240612 08:15" or
+// "20240612 08:15:30"), which are local Chicago time.
+func parseCTATime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.ParseInLocation("20060102 15:04:05", value, chicagoLocation); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("20060102 15:04", value, chicagoLocation)
+}
+
 type ctaVehicle struct {
 	Vid          flexibleString `json:"vid"`
 	Tmstmp       flexibleString `json:"tmstmp"`
@@ -123,6 +373,21 @@ type ctaVehicle struct {
 	Tatripid     flexibleString `json:"tatripid"`
 	Origtatripno flexibleString `json:"origtatripno"`
 	Zone         flexibleString `json:"zone"`
+	Srvtmstmp    flexibleString `json:"srvtmstmp"`
+	Spd          flexibleString `json:"spd"`
+	Psgld        flexibleString `json:"psgld"`
+	Mode         flexibleString `json:"mode"`
+	Blk          flexibleString `json:"blk"`
+	Tripid       flexibleString `json:"tripid"`
+	Tripdyn      flexibleString `json:"tripdyn"`
+	Stst         flexibleString `json:"stst"`
+	Stsd         flexibleString `json:"stsd"`
+	Timepointid  flexibleString `json:"timepointid"`
+	Sequence     flexibleString `json:"sequence"`
+	Gtfsseq      flexibleString `json:"gtfsseq"`
+	Stopstatus   flexibleString `json:"stopstatus"`
+	Stopid       flexibleString `json:"stopid"`
+	Rtpidatafeed flexibleString `json:"rtpidatafeed"`
 }
 
 type ctaVehiclesResponse struct {
@@ -132,11 +397,38 @@ type ctaVehiclesResponse struct {
 	} `json:"bustime-response"`
 }
 
+type ctaPrediction struct {
+	Tmstmp       flexibleString `json:"tmstmp"`
+	Typ          flexibleString `json:"typ"`
+	Stpnm        flexibleString `json:"stpnm"`
+	Stpid        flexibleString `json:"stpid"`
+	Vid          flexibleString `json:"vid"`
+	Dstp         flexibleString `json:"dstp"`
+	Rt           flexibleString `json:"rt"`
+	Rtdir        flexibleString `json:"rtdir"`
+	Des          flexibleString `json:"des"`
+	Prdtm        flexibleString `json:"prdtm"`
+	Prdctdn      flexibleString `json:"prdctdn"`
+	Dly          bool           `json:"dly,omitempty"`
+	Tablockid    flexibleString `json:"tablockid"`
+	Tatripid     flexibleString `json:"tatripid"`
+	Origtatripno flexibleString `json:"origtatripno"`
+}
+
+type ctaPredictionsResponse struct {
+	BustimeResponse struct {
+		Error       []ctaError      `json:"error,omitempty"`
+		Predictions []ctaPrediction `json:"prd,omitempty"`
+	} `json:"bustime-response"`
+}
+
 type route struct {
 	RouteNumber string `json:"routeNumber"`
 	RouteName   string `json:"routeName"`
 	RouteColor  string `json:"routeColor"`
 	Rtdd        string `json:"rtdd"`
+	// HasBulletins is only set when the caller asked for bulletin flags.
+	HasBulletins *bool `json:"hasBulletins,omitempty"`
 }
 
 type vehicle struct {
@@ -154,57 +446,161 @@ type vehicle struct {
 	TripID          string `json:"tripId"`
 	OriginTripNo    string `json:"originTripNo"`
 	Zone            string `json:"zone"`
+
+	// BusTime v3 fields; empty when the feed (or Train Tracker) doesn't send them.
+	// PassengerLoad is "EMPTY", "HALF_EMPTY", "FULL" or "N/A". ScheduledStart
+	// is seconds after midnight of ScheduledStartDate (YYYY-MM-DD).
+	ServerTimestamp    string `json:"serverTimestamp,omitempty"`
+	Speed              string `json:"speed,omitempty"`
+	PassengerLoad      string `json:"passengerLoad,omitempty"`
+	Mode               string `json:"mode,omitempty"`
+	BlockID            string `json:"blockId,omitempty"`
+	ScheduledTripID    string `json:"scheduledTripId,omitempty"`
+	TripDynamic        string `json:"tripDynamic,omitempty"`
+	ScheduledStart     string `json:"scheduledStart,omitempty"`
+	ScheduledStartDate string `json:"scheduledStartDate,omitempty"`
+	TimepointID        string `json:"timepointId,omitempty"`
+	Sequence           string `json:"sequence,omitempty"`
+	GTFSSequence       string `json:"gtfsSequence,omitempty"`
+	StopStatus         string `json:"stopStatus,omitempty"`
+	StopID             string `json:"stopId,omitempty"`
+	DataFeed           string `json:"dataFeed,omitempty"`
+
+	// Set when a bus is fetched from BusTime: how old its CTA timestamp was
+	// then, and how long it had been reporting the same position (0 until it
+	// has reported twice). Nil for vehicles that aren't tracked, like trains.
+	DataAgeSeconds    *int `json:"dataAgeSeconds,omitempty"`
+	StationarySeconds *int `json:"stationarySeconds,omitempty"`
 }
 
+// prediction is an arrival ("A") or departure ("D") estimate for a vehicle at a stop.
+// Countdown is minutes until arrival, or "DUE"/"DLY" as reported by BusTime.
+type prediction struct {
+	StopID         string `json:"stopId"`
+	StopName       string `json:"stopName"`
+	VehicleID      string `json:"vehicleId"`
+	Route          string `json:"route"`
+	RouteDirection string `json:"routeDirection"`
+	Destination    string `json:"destination"`
+	Type           string `json:"type"`
+	PredictedTime  string `json:"predictedTime"`
+	Countdown      string `json:"countdown"`
+	DistanceToStop string `json:"distanceToStop"`
+	Delayed        bool   `json:"delayed"`
+	Timestamp      string `json:"timestamp"`
+	TablockID      string `json:"tablockId"`
+	TripID         string `json:"tripId"`
+	OriginTripNo   string `json:"originTripNo"`
+}
+
+// batchError describes a route batch that could not be fetched.
+type batchError struct {
+	Batch   int      `json:"batch"`
+	Routes  []string `json:"routes"`
+	Status  int      `json:"status"`
+	Message string   `json:"message"`
+}
+
+// vehiclesResult carries the vehicles that were fetched plus the batches that
+// failed. Partial is true when Errors is not empty. FetchedAt and AgeSeconds
+// are set when the result is served from the background poller's snapshot.
+type vehiclesResult struct {
+	Vehicles   []vehicle    `json:"vehicles"`
+	Errors     []batchError `json:"errors"`
+	Partial    bool         `json:"partial"`
+	FetchedAt  *time.Time   `json:"fetchedAt,omitempty"`
+	AgeSeconds *int         `json:"ageSeconds,omitempty"`
+}
+
+// routeStats counts a route's active vehicles. Directions is keyed by the
+// BusTime direction of each vehicle's pattern ("Northbound", "Eastbound",
+// ...), with vehicles whose pattern couldn't be looked up under "unknown".
+// NorthEastbound, SouthWestbound and UnknownDirection are kept for older
+// clients: they follow the pattern direction, and vehicles whose direction
+// is unknown or not a compass direction (e.g. a loop) count as unknown.
 type routeStats struct {
-	RouteNumber    string `json:"routeNumber"`
-	RouteName      string `json:"routeName"`
-	NorthEastbound int    `json:"northEastbound"`
-	SouthWestbound int    `json:"southWestbound"`
-	TotalActive    int    `json:"totalActive"`
+	RouteNumber      string          `json:"routeNumber"`
+	RouteName        string          `json:"routeName"`
+	Directions       map[string]int  `json:"directions"`
+	NorthEastbound   int             `json:"northEastbound"`
+	SouthWestbound   int             `json:"southWestbound"`
+	UnknownDirection int             `json:"unknownDirection"`
+	TotalActive      int             `json:"totalActive"`
+	Crowding         crowdingSummary `json:"crowding"`
+	Bunches          int             `json:"bunches"`
+	BunchedVehicles  int             `json:"bunchedVehicles"`
+}
+
+const unknownDirection = "unknown"
+
+// crowdingSummary counts vehicles by BusTime passenger load.
+type crowdingSummary struct {
+	Empty   int `json:"empty"`
+	Half    int `json:"half"`
+	Full    int `json:"full"`
+	Unknown int `json:"unknown"`
+}
+
+const (
+	passengerLoadEmpty   = "EMPTY"
+	passengerLoadHalf    = "HALF_EMPTY"
+	passengerLoadFull    = "FULL"
+	passengerLoadUnknown = "N/A"
+)
+
+// normalizePassengerLoad maps BusTime's psgld to one of the passengerLoad
+// constants. Missing or unrecognized values become "N/A".
+func normalizePassengerLoad(value string) string {
+	switch strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(value), " ", "_")) {
+	case "EMPTY":
+		return passengerLoadEmpty
+	case "HALF_EMPTY", "HALF_FULL", "HALF":
+		return passengerLoadHalf
+	case "FULL":
+		return passengerLoadFull
+	default:
+		return passengerLoadUnknown
+	}
+}
+
+func (c *crowdingSummary) add(passengerLoad string) {
+	switch normalizePassengerLoad(passengerLoad) {
+	case passengerLoadEmpty:
+		c.Empty++
+	case passengerLoadHalf:
+		c.Half++
+	case passengerLoadFull:
+		c.Full++
+	default:
+		c.Unknown++
+	}
 }
 
 func isNoDataError(ctaErrors []ctaError) bool {
 	for _, err := range ctaErrors {
 		msg := strings.ToLower(err.Msg)
-		if strings.Contains(msg, "no data found") || strings.Contains(msg, "no service scheduled") {
+		if strings.Contains(msg, "no data found") || strings.Contains(msg, "no service scheduled") || strings.Contains(msg, "no arrival times") {
 			return true
 		}
 	}
 	return false
 }
 
+// GetRoutes returns the route list, served from the in-memory route cache
+// when one is configured.
 func (s *CTAService) GetRoutes(ctx context.Context) ([]route, error) {
-	s.logger.Info("fetching routes from CTA API")
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ctaGetRoutesURL, nil)
-	if err != nil {
-		s.logger.Error("failed to create request", "error", err)
-		return nil, err
+	if s.routeCache == nil {
+		return s.fetchRoutes(ctx)
 	}
+	return s.routeCache.get(ctx, s.fetchRoutes)
+}
 
-	query := req.URL.Query()
-	query.Set("format", "json")
-	query.Set("key", s.apiKey)
-	req.URL.RawQuery = query.Encode()
-
-	resp, err := s.client.Do(req)
-	if err != nil {
-		s.logger.Error("CTA API request failed", "error", err)
-		return nil, newAPIError(http.StatusBadGateway, fmt.Sprintf("CTA API request failed: %v", err), nil)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		s.logger.Error("CTA API returned non-OK status", "status", resp.StatusCode, "body", string(body))
-		return nil, newAPIError(http.StatusBadGateway, fmt.Sprintf("CTA API returned status %d: %s", resp.StatusCode, string(body)), nil)
-	}
+func (s *CTAService) fetchRoutes(ctx context.Context) ([]route, error) {
+	s.logger.Info("fetching routes from CTA API")
 
 	var routesResp ctaRoutesResponse
-	if err := json.NewDecoder(resp.Body).Decode(&routesResp); err != nil {
-		s.logger.Error("failed to decode CTA API response", "error", err)
-		return nil, newAPIError(http.StatusBadGateway, fmt.Sprintf("failed to decode CTA API response: %v", err), nil)
+	if err := s.fetch(ctx, ctaGetRoutes, nil, &routesResp); err != nil {
+		return nil, err
 	}
 
 	if len(routesResp.BustimeResponse.Error) > 0 {
@@ -223,11 +619,7 @@ func (s *CTAService) GetRoutes(ctx context.Context) ([]route, error) {
 	}
 
 	s.logger.Info("successfully fetched routes", "count", len(routes))
-	if s.tracker != nil {
-		if err := s.tracker.TrackCall(ctaGetRoutesURL); err != nil {
-			s.logger.Error("failed to track API call", "error", err)
-		}
-	}
+	s.trackCall(ctaGetRoutes)
 	return routes, nil
 }
 
@@ -239,28 +631,92 @@ func (s *CTAService) GetAllVehicles(ctx context.Context) ([]vehicle, error) {
 		return nil, err
 	}
 
-	routeIDs := make([]string, len(routes))
+	allVehicles, _, err := s.fetchVehicleBatches(ctx, batchIdentifiers(routeNumbers(routes), maxBustimeIdentifiers), true)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("successfully fetched all vehicles", "count", len(allVehicles))
+	return allVehicles, nil
+}
+
+// GetAllVehiclesPartial is GetAllVehicles for callers that can use an
+// incomplete answer: batches that fail are reported in Errors instead of
+// failing the whole call.
+func (s *CTAService) GetAllVehiclesPartial(ctx context.Context) (vehiclesResult, error) {
+	s.logger.Info("fetching all vehicles (partial results allowed)")
+
+	routes, err := s.GetRoutes(ctx)
+	if err != nil {
+		return vehiclesResult{}, err
+	}
+	return s.GetVehiclesForRoutes(ctx, routes)
+}
+
+// GetVehiclesForRoutes fetches vehicles for every given route, reporting
+// failed batches in Errors. An error is only returned if every batch fails.
+func (s *CTAService) GetVehiclesForRoutes(ctx context.Context, routes []route) (vehiclesResult, error) {
+	batches := batchIdentifiers(routeNumbers(routes), maxBustimeIdentifiers)
+	allVehicles, batchErrors, err := s.fetchVehicleBatches(ctx, batches, false)
+	if err != nil {
+		return vehiclesResult{}, err
+	}
+
+	result := vehiclesResult{
+		Vehicles: allVehicles,
+		Errors:   batchErrors,
+		Partial:  len(batchErrors) > 0,
+	}
+	if len(batches) > 0 && len(batchErrors) == len(batches) {
+		return vehiclesResult{}, newAPIError(http.StatusBadGateway, "CTA API request failed for every route batch", result)
+	}
+
+	s.logger.Info("successfully fetched vehicles for routes", "count", len(allVehicles), "failedBatches", len(batchErrors))
+	return result, nil
+}
+
+func routeNumbers(routes []route) []string {
+	ids := make([]string, len(routes))
 	for i, r := range routes {
-		routeIDs[i] = r.RouteNumber
+		ids[i] = r.RouteNumber
+	}
+	return ids
+}
+
+// fetchVehicleBatches fetches the batches concurrently with at most
+// s.maxConcurrency requests in flight and returns the vehicles in batch order.
+// With failFast the first failure cancels the outstanding batches and is
+// returned as the error; otherwise every batch runs and failures are
+// reported per batch.
+func (s *CTAService) fetchVehicleBatches(ctx context.Context, batches [][]string, failFast bool) ([]vehicle, []batchError, error) {
+	results, errs, err := fanOut(ctx, s.maxConcurrency, batches, failFast, s.GetVehicles)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	allVehicles := make([]vehicle, 0)
-	batchSize := 10 // a max of 10 identifiers can be specified, so we have to do it in batches
-	for i := 0; i < len(routeIDs); i += batchSize {
-		end := i + batchSize
-		if end > len(routeIDs) {
-			end = len(routeIDs) // catch that we are out of bounds and safely get the last batch
-		}
-		batch := routeIDs[i:end]
-		vehicles, err := s.GetVehicles(ctx, batch)
-		if err != nil {
-			return nil, err
+	batchErrors := make([]batchError, 0)
+	for i, vehicles := range results {
+		if errs[i] != nil {
+			batchErrors = append(batchErrors, newBatchError(i, batches[i], errs[i]))
+			continue
 		}
 		allVehicles = append(allVehicles, vehicles...)
 	}
+	return allVehicles, batchErrors, nil
+}
 
-	s.logger.Info("successfully fetched all vehicles", "count", len(allVehicles))
-	return allVehicles, nil
+func newBatchError(index int, routes []string, err error) batchError {
+	status := http.StatusInternalServerError
+	if apiErr, ok := err.(*apiError); ok {
+		status = apiErr.status
+	}
+	return batchError{
+		Batch:   index,
+		Routes:  routes,
+		Status:  status,
+		Message: err.Error(),
+	}
 }
 
 func (s *CTAService) GetVehicles(ctx context.Context, routes []string) ([]vehicle, error) {
@@ -271,35 +727,12 @@ func (s *CTAService) GetVehicles(ctx context.Context, routes []string) ([]vehicl
 		return nil, newAPIError(http.StatusBadRequest, "at least one route designator is required", nil)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ctaGetVehiclesURL, nil)
-	if err != nil {
-		s.logger.Error("failed to create request", "error", err)
-		return nil, err
-	}
-
-	query := req.URL.Query()
-	query.Set("format", "json")
-	query.Set("key", s.apiKey)
-	query.Set("rt", strings.Join(routes, ","))
-	req.URL.RawQuery = query.Encode()
-
-	resp, err := s.client.Do(req)
-	if err != nil {
-		s.logger.Error("CTA API request failed", "error", err)
-		return nil, newAPIError(http.StatusBadGateway, fmt.Sprintf("CTA API request failed: %v", err), nil)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		s.logger.Error("CTA API returned non-OK status", "status", resp.StatusCode, "body", string(body))
-		return nil, newAPIError(http.StatusBadGateway, fmt.Sprintf("CTA API returned status %d: %s", resp.StatusCode, string(body)), nil)
-	}
+	params := url.Values{}
+	params.Set("rt", strings.Join(routes, ","))
 
 	var vehiclesResp ctaVehiclesResponse
-	if err := json.NewDecoder(resp.Body).Decode(&vehiclesResp); err != nil {
-		s.logger.Error("failed to decode CTA API response", "error", err)
-		return nil, newAPIError(http.StatusBadGateway, fmt.Sprintf("failed to decode CTA API response: %v", err), nil)
+	if err := s.fetch(ctx, ctaGetVehicles, params, &vehiclesResp); err != nil {
+		return nil, err
 	}
 
 	// The CTA API can return both vehicles AND errors in the same response
@@ -331,57 +764,131 @@ func (s *CTAService) GetVehicles(ctx context.Context, routes []string) ([]vehicl
 			TripID:          string(v.Tatripid),
 			OriginTripNo:    string(v.Origtatripno),
 			Zone:            string(v.Zone),
+
+			ServerTimestamp:    string(v.Srvtmstmp),
+			Speed:              string(v.Spd),
+			PassengerLoad:      normalizePassengerLoad(string(v.Psgld)),
+			Mode:               string(v.Mode),
+			BlockID:            string(v.Blk),
+			ScheduledTripID:    string(v.Tripid),
+			TripDynamic:        string(v.Tripdyn),
+			ScheduledStart:     string(v.Stst),
+			ScheduledStartDate: string(v.Stsd),
+			TimepointID:        string(v.Timepointid),
+			Sequence:           string(v.Sequence),
+			GTFSSequence:       string(v.Gtfsseq),
+			StopStatus:         string(v.Stopstatus),
+			StopID:             string(v.Stopid),
+			DataFeed:           string(v.Rtpidatafeed),
 		})
 	}
 
 	s.logger.Info("successfully fetched vehicles", "routes", routes, "count", len(vehicles))
-	if s.tracker != nil {
-		if err := s.tracker.TrackCall(ctaGetVehiclesURL); err != nil {
-			s.logger.Error("failed to track API call", "error", err)
-		}
+	s.trackCall(ctaGetVehicles)
+	s.motion.observe(vehicles)
+	s.motion.tag(vehicles, time.Now())
+	if s.history != nil {
+		s.history.Record(vehicles)
 	}
 	return vehicles, nil
 }
 
-// isNorthOrEastbound determines direction based on heading (0-359 degrees).
-// North: 316-360 or 0-45 (heading toward 0)
-// East: 46-135 (heading toward 90)
-// South: 136-225 (heading toward 180)
-// West: 226-315 (heading toward 270)
-// Returns true for North/East, false for South/West.
-func isNorthOrEastbound(heading string) bool {
-	hdg, err := strconv.Atoi(heading)
-	if err != nil {
-		return false // default to south/west if parsing fails
-	}
-	// Normalize to 0-359
-	hdg = hdg % 360
-	if hdg < 0 {
-		hdg += 360
+// GetPredictions returns arrival predictions for up to 10 stops or up to 10
+// vehicles. Exactly one of stopIDs and vehicleIDs must be provided.
+func (s *CTAService) GetPredictions(ctx context.Context, stopIDs []string, vehicleIDs []string) ([]prediction, error) {
+	s.logger.Info("fetching predictions", "stops", stopIDs, "vehicles", vehicleIDs)
+
+	if (len(stopIDs) == 0) == (len(vehicleIDs) == 0) {
+		s.logger.Error("invalid prediction identifiers")
+		return nil, newAPIError(http.StatusBadRequest, "exactly one of stop IDs or vehicle IDs is required", nil)
 	}
-	// North: 316-360 or 0-45, East: 46-135
-	return hdg >= 316 || hdg <= 135
-}
 
-func (s *CTAService) GetRouteStats(ctx context.Context) ([]routeStats, error) {
-	s.logger.Info("calculating route stats")
+	params := url.Values{}
+	if len(stopIDs) > 0 {
+		params.Set("stpid", strings.Join(stopIDs, ","))
+	} else {
+		params.Set("vid", strings.Join(vehicleIDs, ","))
+	}
 
-	routes, err := s.GetRoutes(ctx)
-	if err != nil {
+	var predictionsResp ctaPredictionsResponse
+	if err := s.fetch(ctx, ctaGetPredictions, params, &predictionsResp); err != nil {
 		return nil, err
 	}
 
-	vehicles, err := s.GetAllVehicles(ctx)
-	if err != nil {
-		return nil, err
+	// Like getvehicles, stops without upcoming buses come back as errors next to the predictions we do have.
+	if len(predictionsResp.BustimeResponse.Predictions) == 0 && len(predictionsResp.BustimeResponse.Error) > 0 {
+		if isNoDataError(predictionsResp.BustimeResponse.Error) {
+			s.logger.Info("no predictions found", "stops", stopIDs, "vehicles", vehicleIDs)
+			return []prediction{}, nil
+		}
+		s.logger.Error("CTA API returned error", "errors", predictionsResp.BustimeResponse.Error)
+		return nil, newAPIError(http.StatusBadGateway, "CTA API returned error", predictionsResp.BustimeResponse)
+	}
+
+	predictions := make([]prediction, 0, len(predictionsResp.BustimeResponse.Predictions))
+	for _, p := range predictionsResp.BustimeResponse.Predictions {
+		predictions = append(predictions, prediction{
+			StopID:         string(p.Stpid),
+			StopName:       string(p.Stpnm),
+			VehicleID:      string(p.Vid),
+			Route:          string(p.Rt),
+			RouteDirection: string(p.Rtdir),
+			Destination:    string(p.Des),
+			Type:           string(p.Typ),
+			PredictedTime:  string(p.Prdtm),
+			Countdown:      string(p.Prdctdn),
+			DistanceToStop: string(p.Dstp),
+			Delayed:        p.Dly,
+			Timestamp:      string(p.Tmstmp),
+			TablockID:      string(p.Tablockid),
+			TripID:         string(p.Tatripid),
+			OriginTripNo:   string(p.Origtatripno),
+		})
 	}
 
+	s.logger.Info("successfully fetched predictions", "count", len(predictions))
+	s.trackCall(ctaGetPredictions)
+	return predictions, nil
+}
+
+// batchIdentifiers splits ids into consecutive batches of at most size entries.
+func batchIdentifiers(ids []string, size int) [][]string {
+	batches := make([][]string, 0, (len(ids)+size-1)/size)
+	for i := 0; i < len(ids); i += size {
+		end := i + size
+		if end > len(ids) {
+			end = len(ids) // catch that we are out of bounds and safely get the last batch
+		}
+		batches = append(batches, ids[i:end])
+	}
+	return batches
+}
+
+// isNorthOrEastboundDirection classifies a BusTime direction name. ok is
+// false for "unknown" and names that are neither, such as loop routes.
+func isNorthOrEastboundDirection(name string) (northEast bool, ok bool) {
+	switch lower := strings.ToLower(name); {
+	case strings.HasPrefix(lower, "north"), strings.HasPrefix(lower, "east"):
+		return true, true
+	case strings.HasPrefix(lower, "south"), strings.HasPrefix(lower, "west"):
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// buildRouteStats counts active vehicles per route and direction, and the
+// bunches closer together than bunchingThreshold feet. directions maps
+// pattern IDs to BusTime direction names. Every route is included, even
+// those without vehicles.
+func buildRouteStats(routes []route, vehicles []vehicle, directions map[string]string, bunchingThreshold int) []routeStats {
 	// Build a map of route number -> stats
 	statsMap := make(map[string]*routeStats)
 	for _, r := range routes {
 		statsMap[r.RouteNumber] = &routeStats{
 			RouteNumber: r.RouteNumber,
 			RouteName:   r.RouteName,
+			Directions:  map[string]int{unknownDirection: 0},
 		}
 	}
 
@@ -391,14 +898,31 @@ func (s *CTAService) GetRouteStats(ctx context.Context) ([]routeStats, error) {
 		if !ok {
 			continue
 		}
-		if isNorthOrEastbound(v.Heading) {
+		dir := directions[v.PatternID]
+		if dir == "" {
+			dir = unknownDirection
+		}
+		stat.Directions[dir]++
+
+		switch northEast, ok := isNorthOrEastboundDirection(dir); {
+		case !ok:
+			stat.UnknownDirection++
+		case northEast:
 			stat.NorthEastbound++
-		} else {
+		default:
 			stat.SouthWestbound++
 		}
+		stat.Crowding.add(v.PassengerLoad)
 		stat.TotalActive++
 	}
 
+	for _, bunch := range detectBunching(vehicles, bunchingThreshold) {
+		if stat, ok := statsMap[bunch.Route]; ok {
+			stat.Bunches++
+			stat.BunchedVehicles += len(bunch.VehicleIDs)
+		}
+	}
+
 	// Convert map to slice and sort by route number
 	result := make([]routeStats, 0, len(statsMap))
 	for _, stat := range statsMap {
@@ -413,9 +937,7 @@ func (s *CTAService) GetRouteStats(ctx context.Context) ([]routeStats, error) {
 		}
 		return result[i].RouteNumber < result[j].RouteNumber
 	})
-
-	s.logger.Info("successfully calculated route stats", "routes", len(result), "totalVehicles", len(vehicles))
-	return result, nil
+	return result
 }
 
 // RidershipService provides business logic for ridership data
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"cta-map/backend/fakebustime"
+)
+
+// largeScenario mimics the size of the real system: 125 routes with two buses each.
+func largeScenario(routeCount int) fakebustime.Scenario {
+	scenario := fakebustime.Scenario{Vehicles: make(map[string][]json.RawMessage)}
+	for i := 1; i <= routeCount; i++ {
+		rt := fmt.Sprint(i)
+		scenario.Routes = append(scenario.Routes, fakebustime.Route{Rt: rt, Rtnm: "Route " + rt, Rtdd: rt})
+		for j := 0; j < 2; j++ {
+			scenario.Vehicles[rt] = append(scenario.Vehicles[rt], json.RawMessage(fmt.Sprintf(
+				`{"vid":"%d%02d","tmstmp":"20240612 08:15","lat":"41.88","lon":"-87.63","hdg":"90","pid":%d,"rt":"%s","des":"Terminal","pdist":%d,"dly":false}`,
+				i, j, i*10, rt, j*5000)))
+		}
+	}
+	return scenario
+}
+
+func BenchmarkGetAllVehicles(b *testing.B) {
+	fake := fakebustime.NewServer(largeScenario(125))
+	fake.SetLatency(20 * time.Millisecond)
+	upstream := httptest.NewServer(fake)
+	defer upstream.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, workers := range []int{1, 4, 8, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			service, err := NewCTAService("test-key", upstream.URL, upstream.Client(), logger, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			service.SetMaxConcurrency(workers)
+
+			for i := 0; i < b.N; i++ {
+				vehicles, err := service.GetAllVehicles(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(vehicles) != 250 {
+					b.Fatalf("expected 250 vehicles, got %d", len(vehicles))
+				}
+				if vehicles[0].Route != "1" || vehicles[len(vehicles)-1].Route != "125" {
+					b.Fatalf("vehicles out of route order: first %s, last %s", vehicles[0].Route, vehicles[len(vehicles)-1].Route)
+				}
+			}
+		})
+	}
+}
+
+func TestGetRoutes(t *testing.T) {
+	service := newFixtureService(t)
+
+	routes, err := service.GetRoutes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 3 {
+		t.Fatalf("expected 3 routes, got %d", len(routes))
+	}
+	want := route{RouteNumber: "9", RouteName: "Ashland", RouteColor: "#ff0000", Rtdd: "9"}
+	if routes[1] != want {
+		t.Fatalf("expected %+v, got %+v", want, routes[1])
+	}
+}
+
+func TestGetVehicles(t *testing.T) {
+	t.Run("numbers and strings", func(t *testing.T) {
+		service := newFixtureService(t)
+
+		vehicles, err := service.GetVehicles(context.Background(), []string{"9", "22", "36"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vehicles) != 2 {
+			t.Fatalf("expected 2 vehicles alongside the no-data error, got %d", len(vehicles))
+		}
+
+		// 1311 is sent with string IDs and numeric pid/pdist, 4015 the other way round
+		first, second := vehicles[0], vehicles[1]
+		if first.VehicleID != "1311" || first.PatternID != "5425" || first.PatternDistance != "3100" || first.Heading != "178" {
+			t.Fatalf("unexpected first vehicle %+v", first)
+		}
+		if first.Speed != "14" || first.ScheduledStart != "29700" || first.PassengerLoad != passengerLoadHalf {
+			t.Fatalf("unexpected v3 fields %+v", first)
+		}
+		if second.VehicleID != "4015" || second.Route != "22" || second.Heading != "350" || second.PatternID != "3932" || second.PatternDistance != "1200" {
+			t.Fatalf("unexpected second vehicle %+v", second)
+		}
+		if second.Latitude != "41.91158" || second.Longitude != "-87.63196" {
+			t.Fatalf("expected numeric coordinates as strings, got %s,%s", second.Latitude, second.Longitude)
+		}
+	})
+
+	for _, tc := range []struct {
+		name  string
+		route string
+	}{
+		{"no data", "36"},
+		{"no service scheduled", "X9"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			service := newFixtureService(t)
+
+			vehicles, err := service.GetVehicles(context.Background(), []string{tc.route})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if vehicles == nil || len(vehicles) != 0 {
+				t.Fatalf("expected an empty vehicle list, got %v", vehicles)
+			}
+		})
+	}
+
+	t.Run("bustime error", func(t *testing.T) {
+		service := newFixtureService(t)
+
+		_, err := service.GetVehicles(context.Background(), []string{"9999"})
+		apiErr, ok := err.(*apiError)
+		if !ok || apiErr.status != http.StatusBadGateway {
+			t.Fatalf("expected 502 apiError, got %v", err)
+		}
+	})
+}
+
+func TestGetAllVehicles(t *testing.T) {
+	service := newFixtureService(t)
+
+	vehicles, err := service.GetAllVehicles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, v := range vehicles {
+		ids = append(ids, v.VehicleID)
+	}
+	if got := strings.Join(ids, ","); got != "1311,4015,7960" {
+		t.Fatalf("expected vehicles from both batches in route order, got %s", got)
+	}
+}
+
+func TestFetchVehicleBatchesStopsWhenCancelled(t *testing.T) {
+	for _, failFast := range []bool{true, false} {
+		fake := fakebustime.NewServer(largeScenario(8))
+		// Long enough that no batch finishes on its own
+		fake.SetLatency(time.Minute)
+		upstream := httptest.NewServer(fake)
+
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		service, err := NewCTAService("test-key", upstream.URL, upstream.Client(), logger, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.SetRetryPolicy(retryPolicy{Attempts: 1})
+		service.SetMaxConcurrency(2)
+
+		batches := make([][]string, 0, 8)
+		for i := 1; i <= 8; i++ {
+			batches = append(batches, []string{fmt.Sprint(i)})
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := service.fetchVehicleBatches(ctx, batches, failFast)
+			done <- err
+		}()
+
+		// Cancel once the first two batches are in flight
+		deadline := time.Now().Add(10 * time.Second)
+		for fake.Calls("getvehicles") < 2 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+
+		// Returning at all, with the upstream a minute away from answering,
+		// shows the in-flight requests were abandoned
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatalf("failFast=%v: expected an error after cancelling", failFast)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("failFast=%v: fetchVehicleBatches didn't return after cancelling", failFast)
+		}
+		upstream.Close()
+		if calls := fake.Calls("getvehicles"); calls != 2 {
+			t.Fatalf("failFast=%v: expected only the 2 in-flight batches to be sent, got %d", failFast, calls)
+		}
+		if peak := fake.PeakInFlight(); peak != 2 {
+			t.Fatalf("failFast=%v: expected 2 requests in flight at most, got %d", failFast, peak)
+		}
+	}
+}
+
+func TestGetRouteStats(t *testing.T) {
+	service := newFixtureService(t)
+	handlers := NewHandlers(service, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	rec := httptest.NewRecorder()
+	if err := handlers.GetRouteStats(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/routes/stats", nil), rec)); err != nil {
+		t.Fatal(err)
+	}
+	var stats []routeStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 12 {
+		t.Fatalf("expected every route, got %d", len(stats))
+	}
+
+	byRoute := make(map[string]routeStats)
+	for _, s := range stats {
+		byRoute[s.RouteNumber] = s
+	}
+	// Vehicle 1900 has no heading but its pattern is northbound
+	ashland := byRoute["9"]
+	if ashland.TotalActive != 3 || ashland.NorthEastbound != 2 || ashland.SouthWestbound != 1 || ashland.UnknownDirection != 0 {
+		t.Fatalf("unexpected route 9 stats %+v", ashland)
+	}
+	if want := map[string]int{"Northbound": 2, "Southbound": 1, "unknown": 0}; !reflect.DeepEqual(ashland.Directions, want) {
+		t.Fatalf("expected route 9 directions %v, got %v", want, ashland.Directions)
+	}
+	if ashland.Crowding != (crowdingSummary{Half: 1, Full: 1, Unknown: 1}) {
+		t.Fatalf("unexpected route 9 crowding %+v", ashland.Crowding)
+	}
+	// BusTime doesn't know pattern 3932, so route 22's bus is unknown
+	// whatever its heading
+	clark := byRoute["22"]
+	if clark.TotalActive != 1 || clark.NorthEastbound != 0 || clark.UnknownDirection != 1 || clark.Directions["unknown"] != 1 || clark.Crowding.Empty != 1 {
+		t.Fatalf("unexpected route 22 stats %+v", clark)
+	}
+	if belmont := byRoute["77"]; belmont.TotalActive != 0 || belmont.RouteName != "Belmont" || !reflect.DeepEqual(belmont.Directions, map[string]int{"unknown": 0}) {
+		t.Fatalf("expected route 77 with no buses, got %+v", belmont)
+	}
+}
+
+func TestBuildRouteStatsDoesNotGuessFromHeading(t *testing.T) {
+	routes := []route{{RouteNumber: "X1"}}
+	vehicles := []vehicle{
+		{VehicleID: "1", Route: "X1", PatternID: "loop", Heading: "90"},
+		{VehicleID: "2", Route: "X1", PatternID: "unlooked", Heading: "180"},
+		{VehicleID: "3", Route: "X1", PatternID: "east", Heading: "270"},
+	}
+	directions := map[string]string{"loop": "Loop", "unlooked": "", "east": "Eastbound"}
+
+	stat := buildRouteStats(routes, vehicles, directions, 0)[0]
+	if stat.NorthEastbound != 1 || stat.SouthWestbound != 0 || stat.UnknownDirection != 2 {
+		t.Fatalf("expected only the eastbound pattern to be classified, got %+v", stat)
+	}
+	if want := map[string]int{"Loop": 1, "Eastbound": 1, "unknown": 1}; !reflect.DeepEqual(stat.Directions, want) {
+		t.Fatalf("expected directions %v, got %v", want, stat.Directions)
+	}
+}
+
+func TestFlexibleStringUnmarshal(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  string
+	}{
+		{`"1311"`, "1311"},
+		{`1311`, "1311"},
+		{`41.91158`, "41.91158"},
+		{`-87.63196`, "-87.63196"},
+		{`""`, ""},
+		{`null`, ""},
+	} {
+		var got flexibleString
+		if err := json.Unmarshal([]byte(tc.input), &got); err != nil {
+			t.Fatalf("%s: %v", tc.input, err)
+		}
+		if string(got) != tc.want {
+			t.Fatalf("%s: expected %q, got %q", tc.input, tc.want, got)
+		}
+	}
+
+	for _, input := range []string{`true`, `{"vid":"1311"}`, `["1311"]`} {
+		var got flexibleString
+		if err := json.Unmarshal([]byte(input), &got); err == nil {
+			t.Fatalf("%s: expected an error, got %q", input, got)
+		}
+	}
+}
+
+func TestIsNoDataError(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		errors []ctaError
+		want   bool
+	}{
+		{"no data", []ctaError{{Msg: "No data found for parameter"}}, true},
+		{"no service", []ctaError{{Msg: "No service scheduled"}}, true},
+		{"no arrivals", []ctaError{{Msg: "No arrival times"}}, true},
+		{"case insensitive", []ctaError{{Msg: "NO DATA FOUND FOR PARAMETER"}}, true},
+		{"mixed", []ctaError{{Msg: "Invalid route parameter"}, {Msg: "No data found for parameter"}}, true},
+		{"other error", []ctaError{{Msg: "Invalid API access key supplied"}}, false},
+		{"none", nil, false},
+	} {
+		if got := isNoDataError(tc.errors); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestServiceBulletinsAreCachedAndFetchedConcurrently(t *testing.T) {
+	scenario := largeScenario(25)
+	scenario.Bulletins = []json.RawMessage{json.RawMessage(`{"nm":"22 Reroute","sbj":"#22 Reroute","prty":"Low","srvc":[{"rt":"22"}]}`)}
+	fake := fakebustime.NewServer(scenario)
+	// Slow enough that concurrent batches overlap at the server
+	fake.SetLatency(200 * time.Millisecond)
+	upstream := httptest.NewServer(fake)
+	defer upstream.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	service, err := NewCTAService("test-key", upstream.URL, upstream.Client(), logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := service.GetRoutes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 25 routes are three batches, fetched side by side
+	routes, err := service.GetRoutesWithBulletins(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peak := fake.PeakInFlight(); peak < 2 || peak > defaultMaxConcurrency {
+		t.Fatalf("expected the batches to be fetched concurrently, got %d requests in flight at most", peak)
+	}
+	for _, r := range routes {
+		if want := r.RouteNumber == "22"; r.HasBulletins == nil || *r.HasBulletins != want {
+			t.Fatalf("route %s: expected hasBulletins %v", r.RouteNumber, want)
+		}
+	}
+
+	// Listing every route again reuses the cached batches
+	if _, err := service.GetRoutesWithBulletins(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	bulletins, err := service.GetServiceBulletins(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bulletins) != 1 || bulletins[0].ID != "22 Reroute" {
+		t.Fatalf("unexpected bulletins %+v", bulletins)
+	}
+	if calls := fake.Calls("getservicebulletins"); calls != 3 {
+		t.Fatalf("expected 3 getservicebulletins calls, got %d", calls)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	trainAPIKeyEnv         = "CTA_TRAIN_API_KEY"
+	trainBaseURLEnv        = "CTA_TRAIN_API_BASE_URL"
+	defaultTrainBaseURL    = "https://lapi.transitchicago.com/api/1.0"
+	ctaTrainPositions      = "ttpositions.aspx"
+	ctaTrainArrivals       = "ttarrivals.aspx"
+	trainTrackerTimeLayout = "2006-01-02T15:04:05"
+	// Train Tracker reports errCd "0" on success.
+	trainTrackerOK = "0"
+)
+
+// trainLines maps the Train Tracker route codes for the eight L lines to
+// their display names.
+var trainLines = map[string]string{
+	"red":  "Red",
+	"blue": "Blue",
+	"brn":  "Brown",
+	"g":    "Green",
+	"org":  "Orange",
+	"p":    "Purple",
+	"pink": "Pink",
+	"y":    "Yellow",
+}
+
+// trainLineOrder is the order lines are requested and returned in.
+var trainLineOrder = []string{"red", "blue", "brn", "g", "org", "p", "pink", "y"}
+
+// normalizeTrainLine accepts a Train Tracker code ("brn") or a line name
+// ("Brown") and returns the code.
+func normalizeTrainLine(line string) (string, bool) {
+	line = strings.ToLower(strings.TrimSpace(line))
+	if _, ok := trainLines[line]; ok {
+		return line, true
+	}
+	for code, name := range trainLines {
+		if strings.ToLower(name) == line {
+			return code, true
+		}
+	}
+	return "", false
+}
+
+// oneOrMany decodes a JSON value that is either a single object or an array
+// of objects. Train Tracker's JSON is converted from XML, so a list with one
+// element is emitted as a bare object.
+type oneOrMany[T any] []T
+
+func (o *oneOrMany[T]) UnmarshalJSON(b []byte) error {
+	trimmed := bytes.TrimSpace(b)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return nil
+	}
+	if trimmed[0] == '[' {
+		var many []T
+		if err := json.Unmarshal(trimmed, &many); err != nil {
+			return err
+		}
+		*o = many
+		return nil
+	}
+	var one T
+	if err := json.Unmarshal(trimmed, &one); err != nil {
+		return err
+	}
+	*o = []T{one}
+	return nil
+}
+
+type ctaTrain struct {
+	Rn        flexibleString `json:"rn"`
+	DestSt    flexibleString `json:"destSt"`
+	DestNm    flexibleString `json:"destNm"`
+	TrDr      flexibleString `json:"trDr"`
+	NextStaID flexibleString `json:"nextStaId"`
+	NextStpID flexibleString `json:"nextStpId"`
+	NextStaNm flexibleString `json:"nextStaNm"`
+	Prdt      flexibleString `json:"prdt"`
+	ArrT      flexibleString `json:"arrT"`
+	IsApp     flexibleString `json:"isApp"`
+	IsDly     flexibleString `json:"isDly"`
+	Lat       flexibleString `json:"lat"`
+	Lon       flexibleString `json:"lon"`
+	Heading   flexibleString `json:"heading"`
+}
+
+type ctaTrainRoute struct {
+	Name   string              `json:"@name"`
+	Trains oneOrMany[ctaTrain] `json:"train"`
+}
+
+type ctaTrainPositionsResponse struct {
+	Ctatt struct {
+		Tmst   flexibleString           `json:"tmst"`
+		ErrCd  flexibleString           `json:"errCd"`
+		ErrNm  flexibleString           `json:"errNm"`
+		Routes oneOrMany[ctaTrainRoute] `json:"route"`
+	} `json:"ctatt"`
+}
+
+type ctaTrainETA struct {
+	StaID   flexibleString `json:"staId"`
+	StpID   flexibleString `json:"stpId"`
+	StaNm   flexibleString `json:"staNm"`
+	StpDe   flexibleString `json:"stpDe"`
+	Rn      flexibleString `json:"rn"`
+	Rt      flexibleString `json:"rt"`
+	DestSt  flexibleString `json:"destSt"`
+	DestNm  flexibleString `json:"destNm"`
+	TrDr    flexibleString `json:"trDr"`
+	Prdt    flexibleString `json:"prdt"`
+	ArrT    flexibleString `json:"arrT"`
+	IsApp   flexibleString `json:"isApp"`
+	IsSch   flexibleString `json:"isSch"`
+	IsDly   flexibleString `json:"isDly"`
+	IsFlt   flexibleString `json:"isFlt"`
+	Lat     flexibleString `json:"lat"`
+	Lon     flexibleString `json:"lon"`
+	Heading flexibleString `json:"heading"`
+}
+
+type ctaTrainArrivalsResponse struct {
+	Ctatt struct {
+		Tmst  flexibleString         `json:"tmst"`
+		ErrCd flexibleString         `json:"errCd"`
+		ErrNm flexibleString         `json:"errNm"`
+		ETAs  oneOrMany[ctaTrainETA] `json:"eta"`
+	} `json:"ctatt"`
+}
+
+// trainVehicle is a train in the same shape as a bus vehicle, so the map can
+// draw both. Route is the Train Tracker line code and VehicleID the run number.
+type trainVehicle struct {
+	vehicle
+	LineName        string `json:"lineName"`
+	NextStationID   string `json:"nextStationId"`
+	NextStationName string `json:"nextStationName"`
+	Approaching     bool   `json:"approaching"`
+}
+
+// trainArrival is one row of an L station arrival board. Scheduled means the
+// prediction is from the schedule rather than a live train, and Fault that
+// Train Tracker flagged a possible problem with the prediction.
+type trainArrival struct {
+	StationID       string `json:"stationId"`
+	StopID          string `json:"stopId"`
+	StationName     string `json:"stationName"`
+	StopDescription string `json:"stopDescription"`
+	RunNumber       string `json:"runNumber"`
+	Line            string `json:"line"`
+	LineName        string `json:"lineName"`
+	Destination     string `json:"destination"`
+	PredictedAt     string `json:"predictedAt"`
+	ArrivalTime     string `json:"arrivalTime"`
+	Approaching     bool   `json:"approaching"`
+	Delayed         bool   `json:"delayed"`
+	Scheduled       bool   `json:"scheduled"`
+	Fault           bool   `json:"fault"`
+}
+
+// TrainService talks to the CTA Train Tracker API, which uses a different
+// API key, URL scheme and response envelope than BusTime.
+type TrainService struct {
+	apiKey  string
+	baseURL string
+	client  *http.Client
+	logger  *slog.Logger
+	tracker *APICallTracker
+	retry   retryPolicy
+	breaker *circuitBreaker
+}
+
+// NewTrainService creates a Train Tracker client. An empty baseURL falls
+// back to the production CTA endpoint.
+func NewTrainService(apiKey string, baseURL string, client *http.Client, logger *slog.Logger, tracker *APICallTracker) (*TrainService, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("%s is not set", trainAPIKeyEnv)
+	}
+	if baseURL == "" {
+		baseURL = defaultTrainBaseURL
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", trainBaseURLEnv, err)
+	}
+	if client == nil {
+		client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &TrainService{
+		apiKey:  apiKey,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  client,
+		logger:  logger,
+		tracker: tracker,
+		retry:   defaultRetryPolicy(),
+		breaker: newCircuitBreaker(trackedAPITrainTracker, defaultBreakerThreshold, defaultBreakerCooldown, logger),
+	}, nil
+}
+
+// SetRetryPolicy sets how failed Train Tracker requests are retried.
+func (s *TrainService) SetRetryPolicy(policy retryPolicy) {
+	s.retry = policy
+}
+
+// SetCircuitBreaker replaces the Train Tracker circuit breaker.
+func (s *TrainService) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	s.breaker = newCircuitBreaker(trackedAPITrainTracker, threshold, cooldown, s.logger)
+}
+
+// BreakerStatus returns the state of the Train Tracker circuit breaker.
+func (s *TrainService) BreakerStatus() breakerStatus {
+	return s.breaker.Status()
+}
+
+func (s *TrainService) endpointURL(endpoint string) string {
+	return s.baseURL + "/" + endpoint
+}
+
+func (s *TrainService) trackCall(endpoint string) {
+	if s.tracker == nil {
+		return
+	}
+	if err := s.tracker.TrackCall(trackedAPITrainTracker, s.endpointURL(endpoint)); err != nil {
+		s.logger.Error("failed to track API call", "error", err)
+	}
+}
+
+// fetch calls a Train Tracker endpoint and decodes the JSON body into out.
+func (s *TrainService) fetch(ctx context.Context, endpoint string, params url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.endpointURL(endpoint), nil)
+	if err != nil {
+		s.logger.Error("failed to create request", "error", err)
+		return err
+	}
+
+	query := req.URL.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	query.Set("outputType", "JSON")
+	query.Set("key", s.apiKey)
+	req.URL.RawQuery = query.Encode()
+
+	resp, err := upstreamGet(ctx, s.client, req, s.retry, s.breaker, s.logger, nil)
+	if err != nil {
+		if apiErr, ok := err.(*apiError); ok {
+			s.logger.Warn("Train Tracker API request refused", "endpoint", endpoint, "error", apiErr)
+			return apiErr
+		}
+		s.logger.Error("Train Tracker API request failed", "endpoint", endpoint, "error", err)
+		return newAPIError(http.StatusBadGateway, fmt.Sprintf("Train Tracker API request failed: %v", err), nil)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		s.logger.Error("Train Tracker API returned non-OK status", "endpoint", endpoint, "status", resp.StatusCode, "body", string(body))
+		return newAPIError(http.StatusBadGateway, fmt.Sprintf("Train Tracker API returned status %d: %s", resp.StatusCode, string(body)), nil)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		s.logger.Error("failed to decode Train Tracker API response", "endpoint", endpoint, "error", err)
+		return newAPIError(http.StatusBadGateway, fmt.Sprintf("failed to decode Train Tracker API response: %v", err), nil)
+	}
+	return nil
+}
+
+// GetTrainPositions returns live positions for the given line codes, or for
+// all eight L lines when none are given.
+func (s *TrainService) GetTrainPositions(ctx context.Context, lines []string) ([]trainVehicle, error) {
+	if len(lines) == 0 {
+		lines = trainLineOrder
+	}
+	s.logger.Info("fetching train positions", "lines", lines)
+
+	params := url.Values{}
+	params.Set("rt", strings.Join(lines, ","))
+
+	var positionsResp ctaTrainPositionsResponse
+	if err := s.fetch(ctx, ctaTrainPositions, params, &positionsResp); err != nil {
+		return nil, err
+	}
+
+	if errCd := string(positionsResp.Ctatt.ErrCd); errCd != "" && errCd != trainTrackerOK {
+		s.logger.Error("Train Tracker API returned error", "code", errCd, "message", positionsResp.Ctatt.ErrNm)
+		return nil, newAPIError(http.StatusBadGateway, "Train Tracker API returned error", positionsResp.Ctatt)
+	}
+
+	trains := make([]trainVehicle, 0)
+	for _, r := range positionsResp.Ctatt.Routes {
+		line := strings.ToLower(r.Name)
+		for _, t := range r.Trains {
+			trains = append(trains, trainVehicle{
+				vehicle: vehicle{
+					VehicleID:   string(t.Rn),
+					Timestamp:   toCTATimestamp(string(t.Prdt)),
+					Latitude:    string(t.Lat),
+					Longitude:   string(t.Lon),
+					Heading:     string(t.Heading),
+					Route:       line,
+					Destination: string(t.DestNm),
+					Delayed:     t.IsDly == "1",
+				},
+				LineName:        trainLines[line],
+				NextStationID:   string(t.NextStaID),
+				NextStationName: string(t.NextStaNm),
+				Approaching:     t.IsApp == "1",
+			})
+		}
+	}
+
+	s.logger.Info("successfully fetched train positions", "lines", lines, "count", len(trains))
+	s.trackCall(ctaTrainPositions)
+	return trains, nil
+}
+
+// GetArrivals returns the arrival board for an L station, identified by its
+// parent station map ID (4xxxx).
+func (s *TrainService) GetArrivals(ctx context.Context, mapID string) ([]trainArrival, error) {
+	s.logger.Info("fetching train arrivals", "mapid", mapID)
+
+	params := url.Values{}
+	params.Set("mapid", mapID)
+
+	var arrivalsResp ctaTrainArrivalsResponse
+	if err := s.fetch(ctx, ctaTrainArrivals, params, &arrivalsResp); err != nil {
+		return nil, err
+	}
+
+	if errCd := string(arrivalsResp.Ctatt.ErrCd); errCd != "" && errCd != trainTrackerOK {
+		s.logger.Error("Train Tracker API returned error", "code", errCd, "message", arrivalsResp.Ctatt.ErrNm)
+		return nil, newAPIError(http.StatusBadGateway, "Train Tracker API returned error", arrivalsResp.Ctatt)
+	}
+
+	arrivals := make([]trainArrival, 0, len(arrivalsResp.Ctatt.ETAs))
+	for _, eta := range arrivalsResp.Ctatt.ETAs {
+		// ttarrivals capitalizes line codes ("Red", "Brn", "G"), so normalize them.
+		line, _ := normalizeTrainLine(string(eta.Rt))
+		arrivals = append(arrivals, trainArrival{
+			StationID:       string(eta.StaID),
+			StopID:          string(eta.StpID),
+			StationName:     string(eta.StaNm),
+			StopDescription: string(eta.StpDe),
+			RunNumber:       string(eta.Rn),
+			Line:            line,
+			LineName:        trainLines[line],
+			Destination:     string(eta.DestNm),
+			PredictedAt:     toCTATimestamp(string(eta.Prdt)),
+			ArrivalTime:     toCTATimestamp(string(eta.ArrT)),
+			Approaching:     eta.IsApp == "1",
+			Delayed:         eta.IsDly == "1",
+			Scheduled:       eta.IsSch == "1",
+			Fault:           eta.IsFlt == "1",
+		})
+	}
+
+	s.logger.Info("successfully fetched train arrivals", "mapid", mapID, "count", len(arrivals))
+	s.trackCall(ctaTrainArrivals)
+	return arrivals, nil
+}
+
+// toCTATimestamp converts Train Tracker's ISO-style local timestamps to the
+// BusTime "YYYYMMDD HH:MM:SS" form used by bus vehicles. Values that do not
+// parse are returned unchanged.
+func toCTATimestamp(value string) string {
+	t, err := time.ParseInLocation(trainTrackerTimeLayout, value, chicagoLocation)
+	if err != nil {
+		return value
+	}
+	return t.Format("20060102 15:04:05")
+}
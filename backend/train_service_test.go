@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestOneOrManyUnmarshal(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  string
+	}{
+		{`{"rn":"801"}`, "801"},
+		{`[{"rn":"801"},{"rn":"802"}]`, "801,802"},
+		{`[{"rn":"801"}]`, "801"},
+		{`[]`, ""},
+		{`null`, ""},
+	} {
+		var got oneOrMany[ctaTrain]
+		if err := json.Unmarshal([]byte(tc.input), &got); err != nil {
+			t.Fatalf("%s: %v", tc.input, err)
+		}
+		runs := make([]string, 0, len(got))
+		for _, train := range got {
+			runs = append(runs, string(train.Rn))
+		}
+		if strings.Join(runs, ",") != tc.want {
+			t.Fatalf("%s: expected runs %q, got %q", tc.input, tc.want, runs)
+		}
+	}
+
+	for _, input := range []string{`"801"`, `[{"rn":true}]`, `{"rn":`} {
+		var got oneOrMany[ctaTrain]
+		if err := json.Unmarshal([]byte(input), &got); err == nil {
+			t.Fatalf("%s: expected an error, got %+v", input, got)
+		}
+	}
+}
+
+func TestTrainServiceDecodesSingleObjects(t *testing.T) {
+	responses := map[string]string{
+		// One line with a single train, one with several
+		ctaTrainPositions: `{"ctatt":{"tmst":"2024-06-12T08:15:00","errCd":"0","errNm":null,"route":[
+			{"@name":"red","train":{"rn":"801","destNm":"Howard","prdt":"2024-06-12T08:14:30","lat":"41.87","lon":"-87.62","heading":"358","isApp":"1","isDly":"0"}},
+			{"@name":"blue","train":[{"rn":"101","destNm":"O'Hare"},{"rn":"102","destNm":"Forest Park","isDly":"1"}]}
+		]}}`,
+		// A station with a single arrival
+		ctaTrainArrivals: `{"ctatt":{"tmst":"2024-06-12T08:15:00","errCd":"0","errNm":null,"eta":
+			{"staId":"40380","stpId":"30074","staNm":"Clark/Lake","rn":"420","rt":"Brn","destNm":"Kimball","prdt":"2024-06-12T08:15:00","arrT":"2024-06-12T08:18:00","isApp":"0","isSch":"1","isDly":"0","isFlt":"0"}
+		}}`,
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[path.Base(r.URL.Path)]
+		if !ok {
+			t.Errorf("unexpected request %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	service, err := NewTrainService("test-key", upstream.URL, upstream.Client(), logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.SetRetryPolicy(retryPolicy{Attempts: 1})
+
+	trains, err := service.GetTrainPositions(context.Background(), []string{"red", "blue"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trains) != 3 {
+		t.Fatalf("expected 3 trains, got %+v", trains)
+	}
+	red := trains[0]
+	if red.VehicleID != "801" || red.Route != "red" || red.LineName != "Red" || red.Timestamp != "20240612 08:14:30" || !red.Approaching || red.Delayed {
+		t.Fatalf("unexpected red line train %+v", red)
+	}
+	if trains[1].VehicleID != "101" || trains[2].VehicleID != "102" || trains[2].Route != "blue" || !trains[2].Delayed {
+		t.Fatalf("unexpected blue line trains %+v", trains[1:])
+	}
+
+	// Trains aren't tracked, so they don't claim a data age or stationary time
+	encoded, err := json.Marshal(trains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encoded), "dataAgeSeconds") || strings.Contains(string(encoded), "stationarySeconds") {
+		t.Fatalf("expected no motion tags on trains, got %s", encoded)
+	}
+
+	arrivals, err := service.GetArrivals(context.Background(), "40380")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arrivals) != 1 {
+		t.Fatalf("expected 1 arrival, got %+v", arrivals)
+	}
+	if a := arrivals[0]; a.RunNumber != "420" || a.Line != "brn" || a.ArrivalTime != "20240612 08:18:00" || !a.Scheduled {
+		t.Fatalf("unexpected arrival %+v", a)
+	}
+}
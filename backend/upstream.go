@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	retryAttemptsEnv        = "CTA_RETRY_ATTEMPTS"
+	retryBaseDelayEnv       = "CTA_RETRY_BASE_DELAY"
+	breakerThresholdEnv     = "CTA_BREAKER_THRESHOLD"
+	breakerCooldownEnv      = "CTA_BREAKER_COOLDOWN"
+	defaultRetryAttempts    = 3
+	defaultRetryBaseDelay   = 200 * time.Millisecond
+	defaultRetryMaxDelay    = 5 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// retryPolicy controls how upstream GETs are retried. Attempts includes the
+// first request.
+type retryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{Attempts: defaultRetryAttempts, BaseDelay: defaultRetryBaseDelay, MaxDelay: defaultRetryMaxDelay}
+}
+
+// backoff returns the delay before the given retry (1 for the first retry),
+// drawn uniformly from zero up to an exponentially growing cap ("full
+// jitter"), so concurrent callers don't retry in lockstep.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	ceiling := p.BaseDelay
+	for i := 1; i < retry && ceiling < p.MaxDelay; i++ {
+		ceiling *= 2
+	}
+	if ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// circuitBreaker stops calls to an upstream after threshold consecutive
+// failures. Once cooldown has passed a single probe request is let through;
+// its outcome closes the breaker or opens it again.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// breakerStatus is a breaker as reported by the health endpoint.
+type breakerStatus struct {
+	State               breakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutiveFailures"`
+	OpenedAt            *time.Time   `json:"openedAt,omitempty"`
+	RetryAt             *time.Time   `json:"retryAt,omitempty"`
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration, logger *slog.Logger) *circuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown, logger: logger, state: breakerClosed}
+}
+
+// allow reports whether a request may go upstream, and if not, how long
+// until the breaker will let a probe through.
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if wait := time.Until(b.openedAt.Add(b.cooldown)); wait > 0 {
+			return false, wait
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		b.logger.Info("circuit breaker half-open; probing upstream", "upstream", b.name)
+		return true, 0
+	case breakerHalfOpen:
+		if b.probing {
+			return false, time.Second
+		}
+		b.probing = true
+		return true, 0
+	default:
+		return true, 0
+	}
+}
+
+// record updates the breaker with the outcome of a request it allowed.
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		if b.state != breakerClosed {
+			b.logger.Info("circuit breaker closed", "upstream", b.name)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.probing = false
+		b.logger.Warn("circuit breaker opened", "upstream", b.name, "consecutiveFailures", b.failures, "cooldown", b.cooldown)
+	}
+}
+
+// abandon releases a request the breaker allowed but that never reached
+// upstream, so a half-open breaker can let another probe through.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) Status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := breakerStatus{State: b.state, ConsecutiveFailures: b.failures}
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		retryAt := b.openedAt.Add(b.cooldown)
+		status.OpenedAt = &openedAt
+		status.RetryAt = &retryAt
+	}
+	return status
+}
+
+// upstreamGet sends an idempotent GET, retrying transport failures and
+// 429/5xx responses with jittered exponential backoff while the breaker
+// allows it. before, if set, runs ahead of every attempt (e.g. to charge the
+// daily budget) and aborts the call when it fails. Refusals are returned as
+// 503 apiErrors; a final transport error is returned as is, and a final
+// non-OK response is returned for the caller to report. The caller closes the
+// response body.
+func upstreamGet(ctx context.Context, client *http.Client, req *http.Request, policy retryPolicy, breaker *circuitBreaker, logger *slog.Logger, before func() error) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if ok, wait := breaker.allow(); !ok {
+			err := newAPIError(http.StatusServiceUnavailable, breaker.name+" circuit breaker is open; upstream calls are paused", nil)
+			err.retryAfter = wait
+			return nil, err
+		}
+		if before != nil {
+			if err := before(); err != nil {
+				breaker.abandon()
+				return nil, err
+			}
+		}
+
+		resp, err := client.Do(req.Clone(ctx))
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			breaker.record(true)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			// The caller gave up; that says nothing about upstream health
+			breaker.abandon()
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		breaker.record(false)
+
+		if attempt >= policy.Attempts {
+			return resp, err
+		}
+
+		delay := policy.backoff(attempt)
+		if err != nil {
+			logger.Warn("retrying upstream request", "upstream", breaker.name, "attempt", attempt, "delay", delay, "error", err)
+		} else {
+			logger.Warn("retrying upstream request", "upstream", breaker.name, "attempt", attempt, "delay", delay, "status", resp.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// isUpstreamRefused reports whether err is a refusal to call upstream at all,
+// from the daily budget or an open circuit breaker.
+func isUpstreamRefused(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.status == http.StatusServiceUnavailable && apiErr.retryAfter > 0
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// fanOut calls fn for every batch with at most limit calls in flight and
+// returns the results and errors in batch order. With failFast the first
+// failure cancels the outstanding calls and is returned as err; otherwise
+// every batch runs and failures are reported in errs. err is also set when
+// ctx is cancelled before every batch has finished.
+func fanOut[T any](ctx context.Context, limit int, batches [][]string, failFast bool, fn func(ctx context.Context, batch []string) (T, error)) ([]T, []error, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]T, len(batches))
+	errs := make([]error, len(batches))
+	var firstErr error
+	var errOnce sync.Once
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+
+dispatch:
+	for i, batch := range batches {
+		// select picks at random when both cases are ready, so check for
+		// cancellation first rather than start another batch
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+
+		wg.Add(1)
+		go func(i int, batch []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, err := fn(ctx, batch)
+			if err != nil {
+				errs[i] = err
+				if failFast {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+				return
+			}
+			results[i] = result
+		}(i, batch)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return results, errs, nil
+}
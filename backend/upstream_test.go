@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cta-map/backend/fakebustime"
+)
+
+func newFaultyService(t *testing.T, policy retryPolicy, threshold int, cooldown time.Duration) (*CTAService, *fakebustime.Server) {
+	t.Helper()
+	fake := fakebustime.NewServer(fakebustime.DefaultScenario())
+	upstream := httptest.NewServer(fake)
+	t.Cleanup(upstream.Close)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	service, err := NewCTAService("test-key", upstream.URL, upstream.Client(), logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.SetRouteCacheTTL(0, 0)
+	service.SetRetryPolicy(policy)
+	service.SetCircuitBreaker(threshold, cooldown)
+	return service, fake
+}
+
+func TestRetryRecoversFromTransientFailures(t *testing.T) {
+	for name, fault := range map[string]fakebustime.Fault{
+		"5xx":     {Status: http.StatusBadGateway, Count: 2},
+		"429":     {Status: http.StatusTooManyRequests, Count: 2},
+		"dropped": {Drop: true, Count: 2},
+	} {
+		fault := fault
+		t.Run(name, func(t *testing.T) {
+			service, fake := newFaultyService(t, retryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}, 5, time.Minute)
+			fake.SetFault(&fault)
+
+			routes, err := service.GetRoutes(context.Background())
+			if err != nil {
+				t.Fatalf("expected retries to recover, got %v", err)
+			}
+			if len(routes) == 0 {
+				t.Fatal("expected routes")
+			}
+			if calls := fake.Calls(ctaGetRoutes); calls != 3 {
+				t.Fatalf("expected 3 upstream calls, got %d", calls)
+			}
+			if state := service.BreakerStatus().State; state != breakerClosed {
+				t.Fatalf("expected breaker closed, got %s", state)
+			}
+		})
+	}
+}
+
+func TestRetryGivesUpAfterAttempts(t *testing.T) {
+	service, fake := newFaultyService(t, retryPolicy{Attempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}, 10, time.Minute)
+	fake.SetFault(&fakebustime.Fault{Status: http.StatusInternalServerError})
+
+	_, err := service.GetRoutes(context.Background())
+	apiErr, ok := err.(*apiError)
+	if !ok || apiErr.status != http.StatusBadGateway {
+		t.Fatalf("expected 502 apiError, got %v", err)
+	}
+	if calls := fake.Calls(ctaGetRoutes); calls != 2 {
+		t.Fatalf("expected 2 upstream calls, got %d", calls)
+	}
+}
+
+func TestRetryDoesNotRetryClientErrors(t *testing.T) {
+	service, fake := newFaultyService(t, retryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}, 5, time.Minute)
+	fake.SetFault(&fakebustime.Fault{Status: http.StatusNotFound})
+
+	if _, err := service.GetRoutes(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if calls := fake.Calls(ctaGetRoutes); calls != 1 {
+		t.Fatalf("expected 1 upstream call, got %d", calls)
+	}
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	cooldown := 50 * time.Millisecond
+	service, fake := newFaultyService(t, retryPolicy{Attempts: 1}, 2, cooldown)
+	fake.SetFault(&fakebustime.Fault{Status: http.StatusServiceUnavailable})
+
+	for i := 0; i < 2; i++ {
+		if _, err := service.GetRoutes(context.Background()); err == nil {
+			t.Fatal("expected upstream failure")
+		}
+	}
+	status := service.BreakerStatus()
+	if status.State != breakerOpen || status.RetryAt == nil {
+		t.Fatalf("expected open breaker with retry time, got %+v", status)
+	}
+
+	_, err := service.GetRoutes(context.Background())
+	if !isUpstreamRefused(err) {
+		t.Fatalf("expected open breaker to refuse the call, got %v", err)
+	}
+	if calls := fake.Calls(ctaGetRoutes); calls != 2 {
+		t.Fatalf("expected open breaker to skip upstream, got %d calls", calls)
+	}
+
+	// A failed probe re-opens the breaker
+	time.Sleep(cooldown)
+	if _, err := service.GetRoutes(context.Background()); err == nil || isUpstreamRefused(err) {
+		t.Fatalf("expected probe to reach upstream and fail, got %v", err)
+	}
+	if state := service.BreakerStatus().State; state != breakerOpen {
+		t.Fatalf("expected breaker to re-open after failed probe, got %s", state)
+	}
+
+	fake.SetFault(nil)
+	time.Sleep(cooldown)
+	if _, err := service.GetRoutes(context.Background()); err != nil {
+		t.Fatalf("expected probe to succeed, got %v", err)
+	}
+	if state := service.BreakerStatus().State; state != breakerClosed {
+		t.Fatalf("expected breaker closed after successful probe, got %s", state)
+	}
+}
+
+func TestBackoffIsCappedAndJittered(t *testing.T) {
+	policy := retryPolicy{Attempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 40 * time.Millisecond}
+	for retry, ceiling := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 10: 40 * time.Millisecond} {
+		for i := 0; i < 100; i++ {
+			if delay := policy.backoff(retry); delay < 0 || delay > ceiling {
+				t.Fatalf("retry %d: delay %s outside [0, %s]", retry, delay, ceiling)
+			}
+		}
+	}
+}
+
+func TestPatternDirectionsRetriesFailedLookups(t *testing.T) {
+	service, fake := newFaultyService(t, retryPolicy{Attempts: 1}, 5, time.Minute)
+	store, err := NewCatalogStore(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	service.SetCatalogStore(store, time.Hour)
+
+	// Cache pattern 5425, then let it go stale
+	if _, err := service.GetPatterns(context.Background(), []string{"5425"}); err != nil {
+		t.Fatal(err)
+	}
+	service.catalogTTL = time.Nanosecond
+
+	// The batch fails: 5425 is served stale, 5424 has nothing to fall back on
+	vehicles := []vehicle{{VehicleID: "1311", PatternID: "5425"}, {VehicleID: "1862", PatternID: "5424"}}
+	fake.SetFault(&fakebustime.Fault{Status: http.StatusInternalServerError, Count: 1})
+	directions := service.PatternDirections(context.Background(), vehicles)
+	if len(directions) != 1 || directions["5425"] != "Southbound" {
+		t.Fatalf("expected only the stale pattern's direction, got %v", directions)
+	}
+
+	// 5424 wasn't remembered as unknown, so it is looked up again
+	directions = service.PatternDirections(context.Background(), vehicles)
+	if directions["5424"] != "Northbound" || directions["5425"] != "Southbound" {
+		t.Fatalf("expected both directions after the fault cleared, got %v", directions)
+	}
+	if calls := fake.Calls("getpatterns"); calls != 3 {
+		t.Fatalf("expected 3 getpatterns calls, got %d", calls)
+	}
+}
+
+func TestFanOutStartsNothingOnceCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	batches := [][]string{{"1"}, {"2"}, {"3"}, {"4"}}
+
+	var started atomic.Int32
+	for i := 0; i < 50; i++ {
+		_, _, err := fanOut(ctx, len(batches), batches, false, func(ctx context.Context, batch []string) (int, error) {
+			started.Add(1)
+			return 0, nil
+		})
+		if err == nil {
+			t.Fatal("expected the cancellation to be returned")
+		}
+	}
+	if n := started.Load(); n != 0 {
+		t.Fatalf("expected no batches to start after cancelling, got %d", n)
+	}
+}
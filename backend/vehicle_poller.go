@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const pollIntervalEnv = "VEHICLE_POLL_INTERVAL"
+
+// vehicleSnapshot is one complete poll of every route. Routes in batches that
+// failed keep their vehicles from the previous snapshot and are listed in Errors.
+// Directions maps the vehicles' pattern IDs to their BusTime direction names.
+// Sequence increases by one with every snapshot since the poller started.
+type vehicleSnapshot struct {
+	Sequence   uint64
+	Routes     []route
+	Vehicles   []vehicle
+	Directions map[string]string
+	Errors     []batchError
+	FetchedAt  time.Time
+}
+
+// Age returns how long ago the snapshot was fetched, rounded to the second.
+func (s vehicleSnapshot) Age() time.Duration {
+	return time.Since(s.FetchedAt).Round(time.Second)
+}
+
+// aged returns the snapshot with its vehicles' DataAgeSeconds measured now
+// rather than when the snapshot was fetched. The shared vehicles are copied,
+// not modified.
+func (s vehicleSnapshot) aged() vehicleSnapshot {
+	age := int(s.Age().Seconds())
+	if age <= 0 {
+		return s
+	}
+	vehicles := make([]vehicle, len(s.Vehicles))
+	for i, v := range s.Vehicles {
+		if v.DataAgeSeconds != nil {
+			dataAge := *v.DataAgeSeconds + age
+			v.DataAgeSeconds = &dataAge
+		}
+		vehicles[i] = v
+	}
+	s.Vehicles = vehicles
+	return s
+}
+
+// VehiclePoller refreshes a single shared vehicle snapshot on a fixed
+// interval, so upstream load no longer scales with the number of clients.
+type VehiclePoller struct {
+	service  *CTAService
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu          sync.RWMutex
+	snapshot    *vehicleSnapshot
+	subscribers map[chan vehicleSnapshot]struct{}
+}
+
+func NewVehiclePoller(service *CTAService, interval time.Duration, logger *slog.Logger) *VehiclePoller {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &VehiclePoller{
+		service:     service,
+		interval:    interval,
+		logger:      logger,
+		subscribers: make(map[chan vehicleSnapshot]struct{}),
+	}
+}
+
+// Start polls immediately and then every interval until ctx is cancelled.
+// The interval is stretched once the daily budget passes a soft limit.
+func (p *VehiclePoller) Start(ctx context.Context) {
+	go func() {
+		p.poll(ctx)
+
+		timer := time.NewTimer(p.nextInterval())
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				p.poll(ctx)
+				timer.Reset(p.nextInterval())
+			}
+		}
+	}()
+}
+
+func (p *VehiclePoller) nextInterval() time.Duration {
+	slowdown := p.service.PollSlowdown()
+	if slowdown > 1 {
+		p.logger.Info("slowing vehicle polling to stay within daily budget", "slowdown", slowdown, "interval", p.interval*time.Duration(slowdown))
+	}
+	return p.interval * time.Duration(slowdown)
+}
+
+// Subscribe returns a channel that receives every new snapshot. A subscriber
+// that falls behind only gets the most recent one, since each snapshot
+// supersedes the last. Call unsubscribe when done.
+func (p *VehiclePoller) Subscribe() (updates <-chan vehicleSnapshot, unsubscribe func()) {
+	ch := make(chan vehicleSnapshot, 1)
+
+	p.mu.Lock()
+	p.subscribers[ch] = struct{}{}
+	p.mu.Unlock()
+
+	return ch, func() {
+		p.mu.Lock()
+		delete(p.subscribers, ch)
+		p.mu.Unlock()
+	}
+}
+
+// publishLocked hands snap to every subscriber, replacing any snapshot they
+// haven't read yet. p.mu must be held.
+func (p *VehiclePoller) publishLocked(snap vehicleSnapshot) {
+	for ch := range p.subscribers {
+		select {
+		case ch <- snap:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- snap
+		}
+	}
+}
+
+// Snapshot returns the latest snapshot. ok is false until the first poll succeeds.
+func (p *VehiclePoller) Snapshot() (snapshot vehicleSnapshot, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.snapshot == nil {
+		return vehicleSnapshot{}, false
+	}
+	return *p.snapshot, true
+}
+
+func (p *VehiclePoller) poll(ctx context.Context) {
+	if p.service.BudgetExhausted() {
+		p.logger.Warn("skipping vehicle poll; daily CTA API budget exhausted")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+
+	start := time.Now()
+	routes, err := p.service.GetRoutes(ctx)
+	if err != nil {
+		p.logger.Error("vehicle poll failed", "error", err)
+		return
+	}
+	result, err := p.service.GetVehiclesForRoutes(ctx, routes)
+	if err != nil {
+		p.logger.Error("vehicle poll failed", "error", err)
+		return
+	}
+
+	next := &vehicleSnapshot{
+		Routes:    routes,
+		Vehicles:  result.Vehicles,
+		Errors:    result.Errors,
+		FetchedAt: time.Now(),
+	}
+
+	// Only poll replaces the snapshot, so it can be read without holding the
+	// lock through the pattern lookups below
+	previous, _ := p.Snapshot()
+	next.Sequence = previous.Sequence + 1
+	if len(result.Errors) > 0 {
+		next.Vehicles = append(next.Vehicles, carriedOverVehicles(previous.Vehicles, result.Errors)...)
+	}
+	// Look directions up here so route stats never call CTA on a request
+	next.Directions = p.service.PatternDirections(ctx, next.Vehicles)
+
+	p.mu.Lock()
+	p.snapshot = next
+	p.publishLocked(*next)
+	p.mu.Unlock()
+
+	p.logger.Info("vehicle snapshot refreshed", "vehicles", len(next.Vehicles), "failedBatches", len(result.Errors), "duration", time.Since(start))
+}
+
+// carriedOverVehicles returns the previous vehicles on routes whose batch
+// failed this time, so a single bad batch doesn't blank those routes.
+func carriedOverVehicles(previous []vehicle, failed []batchError) []vehicle {
+	failedRoutes := make(map[string]bool)
+	for _, be := range failed {
+		for _, rt := range be.Routes {
+			failedRoutes[rt] = true
+		}
+	}
+	carried := make([]vehicle, 0)
+	for _, v := range previous {
+		if failedRoutes[v.Route] {
+			carried = append(carried, v)
+		}
+	}
+	return carried
+}
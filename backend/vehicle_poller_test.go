@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"cta-map/backend/fakebustime"
+)
+
+func TestPollerModeNeverFallsBackToCTA(t *testing.T) {
+	service, fake := newFaultyService(t, retryPolicy{Attempts: 1}, 5, time.Minute)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	poller := NewVehiclePoller(service, time.Minute, logger)
+	handlers := NewHandlers(service, poller, logger)
+	e := echo.New()
+
+	get := func(target string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		if err := handler(e.NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)); err != nil {
+			e.HTTPErrorHandler(err, e.NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec))
+		}
+		return rec
+	}
+
+	// Before the first poll every request is turned away without calling CTA
+	for target, handler := range map[string]echo.HandlerFunc{
+		"/api/vehicles/all":            handlers.GetAllVehicleLocations,
+		"/api/vehicles/locations?rt=9": handlers.GetVehicleLocations,
+		"/api/routes/stats":            handlers.GetRouteStats,
+	} {
+		rec := get(target, handler)
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "60" {
+			t.Fatalf("%s: expected 503 with Retry-After 60, got %d %q", target, rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+	if calls := fake.Calls("getvehicles") + fake.Calls("getpatterns"); calls != 0 {
+		t.Fatalf("expected no CTA calls before the first poll, got %d", calls)
+	}
+
+	poller.poll(context.Background())
+	vehicleCalls, patternCalls := fake.Calls("getvehicles"), fake.Calls("getpatterns")
+
+	// A failed poll keeps the last snapshot, and stats come from it without
+	// looking patterns up again
+	fake.SetFault(&fakebustime.Fault{Status: http.StatusInternalServerError})
+	poller.poll(context.Background())
+	for target, handler := range map[string]echo.HandlerFunc{
+		"/api/vehicles/locations?rt=9": handlers.GetVehicleLocations,
+		"/api/routes/stats":            handlers.GetRouteStats,
+	} {
+		if rec := get(target, handler); rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected the last snapshot, got %d", target, rec.Code)
+		}
+	}
+	fake.SetFault(nil)
+	if fake.Calls("getvehicles") > vehicleCalls+1 || fake.Calls("getpatterns") != patternCalls {
+		t.Fatalf("expected requests to be served from the snapshot, got %d getvehicles and %d getpatterns calls",
+			fake.Calls("getvehicles")-vehicleCalls, fake.Calls("getpatterns")-patternCalls)
+	}
+}
+
+func TestSnapshotAgeCountsTowardsStaleness(t *testing.T) {
+	service, _ := newFaultyService(t, retryPolicy{Attempts: 1}, 5, time.Minute)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	poller := NewVehiclePoller(service, time.Minute, logger)
+	handlers := NewHandlers(service, poller, logger)
+	e := echo.New()
+
+	// Fresh enough when polled, but the snapshot has been served for two minutes
+	snap := &vehicleSnapshot{
+		Vehicles: []vehicle{
+			{VehicleID: "1311", Route: "9", DataAgeSeconds: seconds(200), StationarySeconds: seconds(0)},
+			{VehicleID: "4015", Route: "9", DataAgeSeconds: seconds(30), StationarySeconds: seconds(0)},
+		},
+		FetchedAt: time.Now().Add(-2 * time.Minute),
+	}
+	poller.mu.Lock()
+	poller.snapshot = snap
+	poller.mu.Unlock()
+
+	rec := httptest.NewRecorder()
+	if err := handlers.GetAllVehicleLocations(e.NewContext(httptest.NewRequest(http.MethodGet, "/api/vehicles/all?stale=false", nil), rec)); err != nil {
+		t.Fatal(err)
+	}
+	var fresh []vehicle
+	if err := json.Unmarshal(rec.Body.Bytes(), &fresh); err != nil {
+		t.Fatal(err)
+	}
+	if len(fresh) != 1 || fresh[0].VehicleID != "4015" || tagSeconds(fresh[0].DataAgeSeconds) != 150 {
+		t.Fatalf("expected only 4015, 150s old, got %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	if err := handlers.GetVehicleAnomalies(e.NewContext(httptest.NewRequest(http.MethodGet, "/api/vehicles/anomalies", nil), rec)); err != nil {
+		t.Fatal(err)
+	}
+	var anomalies vehicleAnomalies
+	if err := json.Unmarshal(rec.Body.Bytes(), &anomalies); err != nil {
+		t.Fatal(err)
+	}
+	if len(anomalies.Stale) != 1 || anomalies.Stale[0].VehicleID != "1311" || tagSeconds(anomalies.Stale[0].DataAgeSeconds) != 320 {
+		t.Fatalf("expected 1311 to be stale at 320s, got %s", rec.Body)
+	}
+
+	if *snap.Vehicles[0].DataAgeSeconds != 200 {
+		t.Fatal("expected the shared snapshot to be left unchanged")
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	socketWriteTimeout      = 10 * time.Second
+	socketHeartbeatInterval = 30 * time.Second
+	maxSocketSubscriptions  = 500
+)
+
+// socketRequest is a message from a WebSocket client. Action is "subscribe"
+// or "unsubscribe"; the listed routes, vehicle IDs and bounding boxes are
+// added to or removed from the connection's subscription.
+type socketRequest struct {
+	Action   string        `json:"action,omitempty"`
+	Routes   []string      `json:"routes,omitempty"`
+	Vehicles []string      `json:"vehicles,omitempty"`
+	BBoxes   []boundingBox `json:"bboxes,omitempty"`
+}
+
+type boundingBox struct {
+	MinLat float64 `json:"minLat"`
+	MinLon float64 `json:"minLon"`
+	MaxLat float64 `json:"maxLat"`
+	MaxLon float64 `json:"maxLon"`
+}
+
+func (b boundingBox) valid() bool {
+	return b.MinLat <= b.MaxLat && b.MinLon <= b.MaxLon &&
+		b.MinLat >= -90 && b.MaxLat <= 90 && b.MinLon >= -180 && b.MaxLon <= 180
+}
+
+func (b boundingBox) contains(lat float64, lon float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat && lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// vehicleSubscription is what one WebSocket client asked for. A vehicle
+// matches if it is on any subscribed route, has a subscribed ID or is
+// inside any subscribed bounding box.
+type vehicleSubscription struct {
+	routes   map[string]bool
+	vehicles map[string]bool
+	boxes    []boundingBox
+}
+
+func newVehicleSubscription() *vehicleSubscription {
+	return &vehicleSubscription{routes: make(map[string]bool), vehicles: make(map[string]bool)}
+}
+
+func (s *vehicleSubscription) apply(req socketRequest) error {
+	for _, box := range req.BBoxes {
+		if !box.valid() {
+			return fmt.Errorf("invalid bounding box %+v", box)
+		}
+	}
+
+	switch req.Action {
+	case "subscribe":
+		if len(s.routes)+len(s.vehicles)+len(s.boxes)+len(req.Routes)+len(req.Vehicles)+len(req.BBoxes) > maxSocketSubscriptions {
+			return fmt.Errorf("a maximum of %d routes, vehicles and bounding boxes can be subscribed at once", maxSocketSubscriptions)
+		}
+		for _, rt := range req.Routes {
+			s.routes[rt] = true
+		}
+		for _, vid := range req.Vehicles {
+			s.vehicles[vid] = true
+		}
+		s.boxes = append(s.boxes, req.BBoxes...)
+	case "unsubscribe":
+		for _, rt := range req.Routes {
+			delete(s.routes, rt)
+		}
+		for _, vid := range req.Vehicles {
+			delete(s.vehicles, vid)
+		}
+		kept := s.boxes[:0]
+		for _, box := range s.boxes {
+			if !containsBox(req.BBoxes, box) {
+				kept = append(kept, box)
+			}
+		}
+		s.boxes = kept
+	default:
+		return fmt.Errorf("unknown action %q (must be subscribe or unsubscribe)", req.Action)
+	}
+	return nil
+}
+
+func (s *vehicleSubscription) matches(v vehicle) bool {
+	if s.routes[v.Route] || s.vehicles[v.VehicleID] {
+		return true
+	}
+	if len(s.boxes) == 0 {
+		return false
+	}
+	lat, errLat := strconv.ParseFloat(v.Latitude, 64)
+	lon, errLon := strconv.ParseFloat(v.Longitude, 64)
+	if errLat != nil || errLon != nil {
+		return false
+	}
+	for _, box := range s.boxes {
+		if box.contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// summary returns the subscription as sent back to the client.
+func (s *vehicleSubscription) summary() socketRequest {
+	summary := socketRequest{
+		Routes:   sortedKeys(s.routes),
+		Vehicles: sortedKeys(s.vehicles),
+		BBoxes:   append([]boundingBox{}, s.boxes...),
+	}
+	return summary
+}
+
+func containsBox(boxes []boundingBox, box boundingBox) bool {
+	for _, b := range boxes {
+		if b == box {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// socketMessage is a message to a WebSocket client. Type is "subscribed"
+// (with the full subscription), "delta", "heartbeat" or "error".
+type socketMessage struct {
+	Type         string         `json:"type"`
+	Sequence     uint64         `json:"sequence,omitempty"`
+	Subscription *socketRequest `json:"subscription,omitempty"`
+	Added        []vehicle      `json:"added,omitempty"`
+	Moved        []vehicle      `json:"moved,omitempty"`
+	Removed      []string       `json:"removed,omitempty"`
+	Message      string         `json:"message,omitempty"`
+	Time         *time.Time     `json:"time,omitempty"`
+}
+
+// diffVehicles compares what the client already has with the vehicles that
+// match now. Moved covers any change to a known vehicle's report, not just
+// its position. It returns the new known set.
+func diffVehicles(known map[string]vehicle, current []vehicle, sub *vehicleSubscription) (added []vehicle, moved []vehicle, removed []string, next map[string]vehicle) {
+	next = make(map[string]vehicle)
+	for _, v := range current {
+		if !sub.matches(v) {
+			continue
+		}
+		next[v.VehicleID] = v
+		previous, ok := known[v.VehicleID]
+		switch {
+		case !ok:
+			added = append(added, v)
+		case reportChanged(previous, v):
+			moved = append(moved, v)
+		}
+	}
+	for vid := range known {
+		if _, ok := next[vid]; !ok {
+			removed = append(removed, vid)
+		}
+	}
+	sort.Strings(removed)
+	return added, moved, removed, next
+}
+
+// reportChanged reports whether two versions of a vehicle differ in anything
+// CTA sent. The tags set on every fetch (data age, stationary time) are left
+// out, since they change on every poll even when the report hasn't.
+func reportChanged(previous vehicle, current vehicle) bool {
+	previous.DataAgeSeconds, previous.StationarySeconds = nil, nil
+	current.DataAgeSeconds, current.StationarySeconds = nil, nil
+	return previous != current
+}
+
+// GetVehicleSocket handles GET /api/vehicles/ws, a WebSocket on which clients
+// subscribe to routes, vehicle IDs or bounding boxes and receive only the
+// vehicles added, moved or removed since the last message.
+//
+// Slow consumers are handled by coalescing: snapshots that arrive while a
+// write is in flight replace each other, and the next delta is computed
+// against what the client last received, so it never falls more than one
+// delta behind. A client that can't accept a write within 10 seconds is
+// disconnected.
+func (h *Handlers) GetVehicleSocket(c echo.Context) error {
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path())
+
+	if h.poller == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "vehicle subscriptions require background polling ("+pollIntervalEnv+")")
+	}
+
+	server := websocket.Server{
+		Handshake: func(_ *websocket.Config, req *http.Request) error {
+			if origin := req.Header.Get("Origin"); !socketOriginAllowed(origin, req.Host, h.socketOrigins) {
+				return fmt.Errorf("origin %q is not allowed", origin)
+			}
+			return nil
+		},
+		Handler: h.serveVehicleSocket,
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// socketOriginAllowed reports whether a page from origin may open the
+// socket: pages from the backend's own host and the listed origins can,
+// and clients that send no Origin (not browsers) aren't restricted.
+func socketOriginAllowed(origin string, host string, allowed []string) bool {
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, host) {
+		return true
+	}
+	for _, a := range allowed {
+		if a != "*" && strings.EqualFold(strings.TrimRight(a, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handlers) serveVehicleSocket(ws *websocket.Conn) {
+	defer ws.Close()
+
+	updates, unsubscribe := h.poller.Subscribe()
+	defer unsubscribe()
+
+	// Malformed messages are answered with an error rather than closing the connection
+	type received struct {
+		req socketRequest
+		err error
+	}
+	requests := make(chan received)
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(done)
+		for {
+			var data []byte
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				return
+			}
+			var msg received
+			if err := json.Unmarshal(data, &msg.req); err != nil {
+				msg.err = fmt.Errorf("invalid message: %v", err)
+			}
+			select {
+			case requests <- msg:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	send := func(msg socketMessage) error {
+		ws.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+		return websocket.JSON.Send(ws, msg)
+	}
+
+	sub := newVehicleSubscription()
+	known := make(map[string]vehicle)
+	var latest vehicleSnapshot
+	if snap, ok := h.poller.Snapshot(); ok {
+		latest = snap.aged()
+	}
+
+	sendDelta := func() error {
+		added, moved, removed, next := diffVehicles(known, latest.Vehicles, sub)
+		if len(added) == 0 && len(moved) == 0 && len(removed) == 0 {
+			return nil
+		}
+		if err := send(socketMessage{Type: "delta", Sequence: latest.Sequence, Added: added, Moved: moved, Removed: removed}); err != nil {
+			return err
+		}
+		known = next
+		return nil
+	}
+
+	heartbeat := time.NewTicker(socketHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case msg := <-requests:
+			applyErr := msg.err
+			if applyErr == nil {
+				applyErr = sub.apply(msg.req)
+			}
+			if applyErr != nil {
+				err = send(socketMessage{Type: "error", Message: applyErr.Error()})
+				break
+			}
+			summary := sub.summary()
+			if err = send(socketMessage{Type: "subscribed", Subscription: &summary}); err == nil {
+				err = sendDelta()
+			}
+		case snap := <-updates:
+			latest = snap.aged()
+			err = sendDelta()
+		case now := <-heartbeat.C:
+			err = send(socketMessage{Type: "heartbeat", Sequence: latest.Sequence, Time: &now})
+		}
+		if err != nil {
+			h.logger.Info("vehicle socket closed", "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVehicleSubscriptionMatches(t *testing.T) {
+	sub := newVehicleSubscription()
+	if err := sub.apply(socketRequest{
+		Action:   "subscribe",
+		Routes:   []string{"9"},
+		Vehicles: []string{"4015"},
+		BBoxes:   []boundingBox{{MinLat: 41.9, MinLon: -87.7, MaxLat: 41.95, MaxLon: -87.6}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		v    vehicle
+		want bool
+	}{
+		{"subscribed route", vehicle{VehicleID: "1311", Route: "9"}, true},
+		{"subscribed vehicle", vehicle{VehicleID: "4015", Route: "22"}, true},
+		{"inside a box", vehicle{VehicleID: "7960", Route: "77", Latitude: "41.93", Longitude: "-87.65"}, true},
+		{"on the box edge", vehicle{VehicleID: "7960", Route: "77", Latitude: "41.95", Longitude: "-87.6"}, true},
+		{"outside every box", vehicle{VehicleID: "7960", Route: "77", Latitude: "41.88", Longitude: "-87.65"}, false},
+		{"unparsable position", vehicle{VehicleID: "7960", Route: "77", Latitude: "", Longitude: "-87.65"}, false},
+		{"nothing matches", vehicle{VehicleID: "8012", Route: "66"}, false},
+	} {
+		if got := sub.matches(tc.v); got != tc.want {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+
+	// Unsubscribing a route leaves the other criteria in place
+	if err := sub.apply(socketRequest{Action: "unsubscribe", Routes: []string{"9"}}); err != nil {
+		t.Fatal(err)
+	}
+	if sub.matches(vehicle{VehicleID: "1311", Route: "9"}) || !sub.matches(vehicle{VehicleID: "4015", Route: "22"}) {
+		t.Fatal("expected only route 9 to be unsubscribed")
+	}
+}
+
+func TestDiffVehicles(t *testing.T) {
+	sub := newVehicleSubscription()
+	sub.routes["9"] = true
+
+	known := map[string]vehicle{
+		"1311": {VehicleID: "1311", Route: "9", Timestamp: "20240612 08:15", Latitude: "41.88416"},
+		"1862": {VehicleID: "1862", Route: "9", Timestamp: "20240612 08:15", Latitude: "41.90000"},
+		"1900": {VehicleID: "1900", Route: "9", Timestamp: "20240612 08:15", Latitude: "41.91000"},
+	}
+
+	for _, tc := range []struct {
+		name                  string
+		current               []vehicle
+		added, moved, removed string
+	}{
+		{
+			name:    "unchanged",
+			current: []vehicle{known["1311"], known["1862"], known["1900"]},
+		},
+		{
+			name: "moved, added and removed",
+			current: []vehicle{
+				known["1311"],
+				{VehicleID: "1862", Route: "9", Timestamp: "20240612 08:16", Latitude: "41.90500"},
+				{VehicleID: "1420", Route: "9", Timestamp: "20240612 08:16"},
+			},
+			added:   "1420",
+			moved:   "1862",
+			removed: "1900",
+		},
+		{
+			name:    "left the subscription",
+			current: []vehicle{known["1311"], known["1862"], {VehicleID: "1900", Route: "22", Timestamp: "20240612 08:16"}},
+			removed: "1900",
+		},
+		{
+			name: "only the per-fetch tags changed",
+			current: []vehicle{
+				known["1311"],
+				known["1862"],
+				{VehicleID: "1900", Route: "9", Timestamp: "20240612 08:15", Latitude: "41.91000", DataAgeSeconds: seconds(90), StationarySeconds: seconds(60)},
+			},
+		},
+	} {
+		added, moved, removed, next := diffVehicles(known, tc.current, sub)
+		if got := vehicleIDs(added); got != tc.added {
+			t.Fatalf("%s: expected added %q, got %q", tc.name, tc.added, got)
+		}
+		if got := vehicleIDs(moved); got != tc.moved {
+			t.Fatalf("%s: expected moved %q, got %q", tc.name, tc.moved, got)
+		}
+		if got := strings.Join(removed, ","); got != tc.removed {
+			t.Fatalf("%s: expected removed %q, got %q", tc.name, tc.removed, got)
+		}
+		for _, vid := range removed {
+			if _, ok := next[vid]; ok {
+				t.Fatalf("%s: removed vehicle %s is still known", tc.name, vid)
+			}
+		}
+	}
+}
+
+func TestSocketOriginAllowed(t *testing.T) {
+	allowed := []string{"*", "http://localhost:5173"}
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://localhost:8080", true},
+		{"http://localhost:5173", true},
+		{"https://evil.example", false},
+		{"http://localhost:8080.evil.example", false},
+		{"::not a url", false},
+	} {
+		if got := socketOriginAllowed(tc.origin, "localhost:8080", allowed); got != tc.want {
+			t.Fatalf("%q: expected %v, got %v", tc.origin, tc.want, got)
+		}
+	}
+}
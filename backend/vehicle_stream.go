@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	streamHeartbeatInterval = 15 * time.Second
+	streamRetryMillis       = 5000
+)
+
+// streamHeartbeat is the payload of the SSE "heartbeat" event.
+type streamHeartbeat struct {
+	Time        time.Time `json:"time"`
+	LastEventID uint64    `json:"lastEventId"`
+}
+
+// GetVehicleStream handles GET /api/vehicles/stream?rt=9,22, a Server-Sent
+// Events stream with one "vehicles" event per poller snapshot (filtered to the
+// requested routes, or every route when rt is omitted) and a "heartbeat"
+// event every 15 seconds. Event IDs are snapshot sequence numbers; a client
+// reconnecting with Last-Event-ID gets the current snapshot immediately if it
+// missed any, since each snapshot supersedes the ones before it.
+// ?stale=false leaves stale vehicles out of every event.
+func (h *Handlers) GetVehicleStream(c echo.Context) error {
+	routeParam := strings.TrimSpace(c.QueryParam("rt"))
+
+	h.logger.Info("request received", "method", c.Request().Method, "path", c.Path(), "routes", routeParam)
+
+	if h.poller == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "vehicle streaming requires background polling ("+pollIntervalEnv+")")
+	}
+
+	routeIDs := splitIdentifiers(routeParam)
+	hideStale, err := parseHideStale(c)
+	if err != nil {
+		return err
+	}
+	var staleAfter time.Duration
+	if hideStale {
+		staleAfter = h.ctaService.StaleAfter()
+	}
+
+	var lastEventID uint64
+	if raw := strings.TrimSpace(c.Request().Header.Get("Last-Event-ID")); raw != "" {
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid Last-Event-ID header")
+		}
+		lastEventID = parsed
+	}
+
+	updates, unsubscribe := h.poller.Subscribe()
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", streamRetryMillis); err != nil {
+		return nil
+	}
+	w.Flush()
+
+	// A snapshot published between Subscribe and here is also queued on
+	// updates; the sequence check below keeps it from being sent twice
+	if snap, ok := h.poller.Snapshot(); ok && snap.Sequence != lastEventID {
+		if err := writeVehicleEvent(w, snap, routeIDs, staleAfter); err != nil {
+			return nil
+		}
+		lastEventID = snap.Sequence
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case snap := <-updates:
+			if snap.Sequence == lastEventID {
+				continue
+			}
+			if err := writeVehicleEvent(w, snap, routeIDs, staleAfter); err != nil {
+				h.logger.Info("vehicle stream closed", "error", err)
+				return nil
+			}
+			lastEventID = snap.Sequence
+		case now := <-heartbeat.C:
+			if err := writeSSE(w, "heartbeat", "", streamHeartbeat{Time: now.UTC(), LastEventID: lastEventID}); err != nil {
+				h.logger.Info("vehicle stream closed", "error", err)
+				return nil
+			}
+		}
+	}
+}
+
+// writeVehicleEvent sends snap as a "vehicles" event in the same envelope as
+// /api/vehicles/all?partial=true, limited to routeIDs when any are given and
+// without stale vehicles when staleAfter is set.
+func writeVehicleEvent(w *echo.Response, snap vehicleSnapshot, routeIDs []string, staleAfter time.Duration) error {
+	snap = snap.aged()
+	vehicles, batchErrors := snap.Vehicles, snap.Errors
+	if len(routeIDs) > 0 {
+		vehicles = filterVehiclesByRoute(vehicles, routeIDs)
+		batchErrors = filterBatchErrorsByRoute(batchErrors, routeIDs)
+	}
+	if staleAfter > 0 {
+		vehicles = withoutStale(vehicles, staleAfter)
+	}
+	if batchErrors == nil {
+		batchErrors = []batchError{}
+	}
+
+	fetchedAt := snap.FetchedAt
+	age := int(snap.Age().Seconds())
+	return writeSSE(w, "vehicles", strconv.FormatUint(snap.Sequence, 10), vehiclesResult{
+		Vehicles:   vehicles,
+		Errors:     batchErrors,
+		Partial:    len(batchErrors) > 0,
+		FetchedAt:  &fetchedAt,
+		AgeSeconds: &age,
+	})
+}
+
+// writeSSE writes one event with a JSON data line and flushes it.
+func writeSSE(w *echo.Response, event string, id string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// filterBatchErrorsByRoute keeps the failed batches that include any of routeIDs.
+func filterBatchErrorsByRoute(batchErrors []batchError, routeIDs []string) []batchError {
+	wanted := make(map[string]bool, len(routeIDs))
+	for _, rt := range routeIDs {
+		wanted[rt] = true
+	}
+	filtered := make([]batchError, 0)
+	for _, be := range batchErrors {
+		for _, rt := range be.Routes {
+			if wanted[rt] {
+				filtered = append(filtered, be)
+				break
+			}
+		}
+	}
+	return filtered
+}
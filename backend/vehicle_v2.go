@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vehicleV2 is the typed vehicle served under /api/v2: coordinates, heading
+// and pattern distance are numbers and the timestamp is RFC3339 with the
+// Chicago offset, so clients don't have to re-parse BusTime's strings.
+type vehicleV2 struct {
+	VehicleID       string    `json:"vehicleId"`
+	Timestamp       time.Time `json:"timestamp"`
+	Latitude        float64   `json:"latitude"`
+	Longitude       float64   `json:"longitude"`
+	Heading         int       `json:"heading"`
+	PatternID       string    `json:"patternId"`
+	PatternDistance int       `json:"patternDistance"`
+	Route           string    `json:"route"`
+	Destination     string    `json:"destination"`
+	Delayed         bool      `json:"delayed"`
+	TablockID       string    `json:"tablockId"`
+	TripID          string    `json:"tripId"`
+	OriginTripNo    string    `json:"originTripNo"`
+	Zone            string    `json:"zone"`
+
+	// Optional BusTime v3 fields; nil or empty when the feed doesn't send them.
+	ServerTimestamp *time.Time `json:"serverTimestamp,omitempty"`
+	Speed           *int       `json:"speed,omitempty"`
+	PassengerLoad   string     `json:"passengerLoad,omitempty"`
+	Mode            string     `json:"mode,omitempty"`
+	BlockID         string     `json:"blockId,omitempty"`
+	ScheduledTripID string     `json:"scheduledTripId,omitempty"`
+	ScheduledStart  *time.Time `json:"scheduledStart,omitempty"`
+	TimepointID     string     `json:"timepointId,omitempty"`
+	Sequence        string     `json:"sequence,omitempty"`
+	GTFSSequence    string     `json:"gtfsSequence,omitempty"`
+	StopStatus      string     `json:"stopStatus,omitempty"`
+	StopID          string     `json:"stopId,omitempty"`
+
+	DataAgeSeconds    *int `json:"dataAgeSeconds,omitempty"`
+	StationarySeconds *int `json:"stationarySeconds,omitempty"`
+}
+
+// vehicleValidationError describes one field of an upstream vehicle row that
+// could not be converted to a vehicleV2. The row is left out of the result.
+type vehicleValidationError struct {
+	VehicleID string `json:"vehicleId"`
+	Route     string `json:"route"`
+	Field     string `json:"field"`
+	Value     string `json:"value"`
+	Message   string `json:"message"`
+}
+
+// vehiclesV2Result is the /api/v2 vehicles envelope. Invalid lists the
+// validation errors for rows that were dropped; Errors and Partial report
+// failed upstream batches as in vehiclesResult.
+type vehiclesV2Result struct {
+	Vehicles   []vehicleV2              `json:"vehicles"`
+	Invalid    []vehicleValidationError `json:"invalid"`
+	Errors     []batchError             `json:"errors"`
+	Partial    bool                     `json:"partial"`
+	FetchedAt  *time.Time               `json:"fetchedAt,omitempty"`
+	AgeSeconds *int                     `json:"ageSeconds,omitempty"`
+}
+
+// toVehiclesV2 converts vehicles, keeping the valid rows in order and
+// collecting every field error of the invalid ones.
+func toVehiclesV2(vehicles []vehicle) ([]vehicleV2, []vehicleValidationError) {
+	valid := make([]vehicleV2, 0, len(vehicles))
+	invalid := make([]vehicleValidationError, 0)
+	for _, v := range vehicles {
+		converted, errs := toVehicleV2(v)
+		if len(errs) > 0 {
+			invalid = append(invalid, errs...)
+			continue
+		}
+		valid = append(valid, converted)
+	}
+	return valid, invalid
+}
+
+// toVehicleV2 converts a vehicle, validating its required fields and any
+// optional v3 fields BusTime sent.
+func toVehicleV2(v vehicle) (vehicleV2, []vehicleValidationError) {
+	converted, errs := vehiclePosition(v)
+	invalid := func(field string, value string, message string) {
+		errs = append(errs, newVehicleValidationError(v, field, value, message))
+	}
+
+	if v.ServerTimestamp != "" {
+		if t, err := parseCTATime(v.ServerTimestamp); err != nil {
+			invalid("serverTimestamp", v.ServerTimestamp, "expected YYYYMMDD HH:MM in America/Chicago")
+		} else {
+			converted.ServerTimestamp = &t
+		}
+	}
+
+	if v.Speed != "" {
+		if mph, err := strconv.Atoi(strings.TrimSpace(v.Speed)); err != nil || mph < 0 {
+			invalid("speed", v.Speed, "expected a non-negative whole number of miles per hour")
+		} else {
+			converted.Speed = &mph
+		}
+	}
+
+	if v.ScheduledStartDate != "" || v.ScheduledStart != "" {
+		if t, err := parseScheduledStart(v.ScheduledStartDate, v.ScheduledStart); err != nil {
+			invalid("scheduledStart", v.ScheduledStartDate+" "+v.ScheduledStart, "expected a YYYY-MM-DD date and seconds after midnight")
+		} else {
+			converted.ScheduledStart = &t
+		}
+	}
+
+	if len(errs) > 0 {
+		return vehicleV2{}, errs
+	}
+	return converted, nil
+}
+
+// vehiclePosition converts a vehicle, validating only the fields every
+// vehicle must have: its ID, timestamp, position, heading and distance along
+// its pattern. The optional v3 fields that need parsing are left unset.
+func vehiclePosition(v vehicle) (vehicleV2, []vehicleValidationError) {
+	var errs []vehicleValidationError
+	invalid := func(field string, value string, message string) {
+		errs = append(errs, newVehicleValidationError(v, field, value, message))
+	}
+
+	if strings.TrimSpace(v.VehicleID) == "" {
+		invalid("vehicleId", v.VehicleID, "vehicle ID is empty")
+	}
+
+	timestamp, err := parseCTATime(v.Timestamp)
+	if err != nil {
+		invalid("timestamp", v.Timestamp, "expected YYYYMMDD HH:MM in America/Chicago")
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(v.Latitude), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		invalid("latitude", v.Latitude, "expected a latitude between -90 and 90")
+	}
+
+	lon, err := strconv.ParseFloat(strings.TrimSpace(v.Longitude), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		invalid("longitude", v.Longitude, "expected a longitude between -180 and 180")
+	}
+
+	heading, err := parseHeading(v.Heading)
+	if err != nil {
+		invalid("heading", v.Heading, "expected a heading between 0 and 360 degrees")
+	}
+
+	pdist, err := strconv.Atoi(strings.TrimSpace(v.PatternDistance))
+	if err != nil || pdist < 0 {
+		invalid("patternDistance", v.PatternDistance, "expected a non-negative whole number of feet")
+	}
+
+	if len(errs) > 0 {
+		return vehicleV2{}, errs
+	}
+	return vehicleV2{
+		VehicleID:       v.VehicleID,
+		Timestamp:       timestamp,
+		Latitude:        lat,
+		Longitude:       lon,
+		Heading:         heading,
+		PatternID:       v.PatternID,
+		PatternDistance: pdist,
+		Route:           v.Route,
+		Destination:     v.Destination,
+		Delayed:         v.Delayed,
+		TablockID:       v.TablockID,
+		TripID:          v.TripID,
+		OriginTripNo:    v.OriginTripNo,
+		Zone:            v.Zone,
+
+		PassengerLoad:   v.PassengerLoad,
+		Mode:            v.Mode,
+		BlockID:         v.BlockID,
+		ScheduledTripID: v.ScheduledTripID,
+		TimepointID:     v.TimepointID,
+		Sequence:        v.Sequence,
+		GTFSSequence:    v.GTFSSequence,
+		StopStatus:      v.StopStatus,
+		StopID:          v.StopID,
+
+		DataAgeSeconds:    v.DataAgeSeconds,
+		StationarySeconds: v.StationarySeconds,
+	}, nil
+}
+
+func newVehicleValidationError(v vehicle, field string, value string, message string) vehicleValidationError {
+	return vehicleValidationError{
+		VehicleID: v.VehicleID,
+		Route:     v.Route,
+		Field:     field,
+		Value:     value,
+		Message:   message,
+	}
+}
+
+// parseScheduledStart combines BusTime's stsd (YYYY-MM-DD) and stst (seconds
+// after midnight, which may run past 24 hours for late trips) into a time.
+func parseScheduledStart(date string, seconds string) (time.Time, error) {
+	day, err := time.ParseInLocation(time.DateOnly, strings.TrimSpace(date), chicagoLocation)
+	if err != nil {
+		return time.Time{}, err
+	}
+	offset, err := strconv.Atoi(strings.TrimSpace(seconds))
+	if err != nil || offset < 0 {
+		return time.Time{}, fmt.Errorf("invalid scheduled start seconds %q", seconds)
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, offset, 0, chicagoLocation), nil
+}
+
+// parseHeading parses a BusTime heading in degrees, normalizing 360 to 0.
+func parseHeading(value string) (int, error) {
+	heading, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	if heading < 0 || heading > 360 {
+		return 0, fmt.Errorf("heading %d out of range", heading)
+	}
+	return heading % 360, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToVehicleV2(t *testing.T) {
+	valid := vehicle{VehicleID: "1311", Route: "9", PatternID: "5425", PatternDistance: "1200", Latitude: "41.88416", Longitude: "-87.66630", Heading: "360", Timestamp: "20240612 08:15"}
+
+	converted, errs := toVehicleV2(valid)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors %+v", errs)
+	}
+	if want := time.Date(2024, 6, 12, 8, 15, 0, 0, chicagoLocation); !converted.Timestamp.Equal(want) {
+		t.Fatalf("expected timestamp %s, got %s", want, converted.Timestamp)
+	}
+	if converted.Heading != 0 || converted.PatternDistance != 1200 || converted.Latitude != 41.88416 || converted.Longitude != -87.6663 {
+		t.Fatalf("unexpected conversion %+v", converted)
+	}
+	if converted.ServerTimestamp != nil || converted.Speed != nil || converted.ScheduledStart != nil {
+		t.Fatalf("expected missing optional fields to stay nil, got %+v", converted)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(v *vehicle)
+		fields string
+	}{
+		{"empty vehicle ID", func(v *vehicle) { v.VehicleID = " " }, "vehicleId"},
+		{"unparsable timestamp", func(v *vehicle) { v.Timestamp = "2024-06-12T08:15:00" }, "timestamp"},
+		{"latitude out of range", func(v *vehicle) { v.Latitude = "91" }, "latitude"},
+		{"unparsable longitude", func(v *vehicle) { v.Longitude = "west" }, "longitude"},
+		{"longitude out of range", func(v *vehicle) { v.Longitude = "-180.5" }, "longitude"},
+		{"heading out of range", func(v *vehicle) { v.Heading = "361" }, "heading"},
+		{"negative heading", func(v *vehicle) { v.Heading = "-1" }, "heading"},
+		{"negative pattern distance", func(v *vehicle) { v.PatternDistance = "-5" }, "patternDistance"},
+		{"fractional pattern distance", func(v *vehicle) { v.PatternDistance = "12.5" }, "patternDistance"},
+		{"bad server timestamp", func(v *vehicle) { v.ServerTimestamp = "yesterday" }, "serverTimestamp"},
+		{"negative speed", func(v *vehicle) { v.Speed = "-3" }, "speed"},
+		{"scheduled start without seconds", func(v *vehicle) { v.ScheduledStartDate = "2024-06-12" }, "scheduledStart"},
+		{"every position field", func(v *vehicle) { v.Latitude, v.Longitude, v.Heading = "", "", "" }, "latitude,longitude,heading"},
+	} {
+		v := valid
+		tc.modify(&v)
+		converted, errs := toVehicleV2(v)
+		fields := make([]string, 0, len(errs))
+		for _, err := range errs {
+			fields = append(fields, err.Field)
+			if err.VehicleID != v.VehicleID || err.Route != "9" || err.Message == "" {
+				t.Fatalf("%s: incomplete error %+v", tc.name, err)
+			}
+		}
+		if got := strings.Join(fields, ","); got != tc.fields {
+			t.Fatalf("%s: expected errors for %s, got %s", tc.name, tc.fields, got)
+		}
+		if converted != (vehicleV2{}) {
+			t.Fatalf("%s: expected no vehicle, got %+v", tc.name, converted)
+		}
+	}
+}
+
+func TestParseHeading(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  int
+		ok    bool
+	}{
+		{"0", 0, true},
+		{" 90 ", 90, true},
+		{"359", 359, true},
+		{"360", 0, true},
+		{"361", 0, false},
+		{"-1", 0, false},
+		{"90.5", 0, false},
+		{"", 0, false},
+	} {
+		got, err := parseHeading(tc.value)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Fatalf("%q: expected %d (ok=%v), got %d (err=%v)", tc.value, tc.want, tc.ok, got, err)
+		}
+	}
+}
+
+func TestParseScheduledStart(t *testing.T) {
+	for _, tc := range []struct {
+		date, seconds string
+		want          time.Time
+		ok            bool
+	}{
+		{"2024-06-12", "0", time.Date(2024, 6, 12, 0, 0, 0, 0, chicagoLocation), true},
+		{"2024-06-12", "30600", time.Date(2024, 6, 12, 8, 30, 0, 0, chicagoLocation), true},
+		// stst runs past 24 hours for trips that start after midnight on the
+		// previous service day
+		{"2024-06-12", "90000", time.Date(2024, 6, 13, 1, 0, 0, 0, chicagoLocation), true},
+		{"2024-06-12", "-60", time.Time{}, false},
+		{"2024-06-12", "", time.Time{}, false},
+		{"20240612", "30600", time.Time{}, false},
+		{"", "30600", time.Time{}, false},
+	} {
+		got, err := parseScheduledStart(tc.date, tc.seconds)
+		if (err == nil) != tc.ok || !got.Equal(tc.want) {
+			t.Fatalf("%q %q: expected %s (ok=%v), got %s (err=%v)", tc.date, tc.seconds, tc.want, tc.ok, got, err)
+		}
+	}
+}
@@ -27,6 +27,7 @@ export type ApiRoute = {
     routeName: string;
     routeColor: string;
     rtdd: string;
+    hasBulletins?: boolean;
 };
 
 export type ApiVehicle = {
@@ -44,6 +45,12 @@ export type ApiVehicle = {
     tripId: string;
     originTripNo: string;
     zone: string;
+    passengerLoad?: "EMPTY" | "HALF_EMPTY" | "FULL" | "N/A";
+    blockId?: string;
+    scheduledTripId?: string;
+    speed?: string;
+    dataAgeSeconds?: number;
+    stationarySeconds?: number;
 };
 
 const jsonHeaders = { Accept: "application/json" };
@@ -77,23 +84,60 @@ export const fetchVehicles = async (routeIds: string[]): Promise<ApiVehicle[]> =
     return response.json();
 };
 
+export type ApiBatchError = {
+    batch: number;
+    routes: string[];
+    status: number;
+    message: string;
+};
+
+export type ApiVehiclesResult = {
+    vehicles: ApiVehicle[];
+    errors: ApiBatchError[];
+    partial: boolean;
+};
+
+// Server-Sent Events stream of vehicle snapshots for the given routes; each
+// "vehicles" event carries an ApiVehiclesResult.
+export const openVehicleStream = (routeIds: string[]): EventSource => {
+    const params = new URLSearchParams({ rt: routeIds.join(",") });
+    return new EventSource(`${API_BASE_URL}/vehicles/stream?${params.toString()}`);
+};
+
+// Requests partial results so one failing route batch doesn't blank the map;
+// the backend answers 207 when some batches are missing.
 export const fetchAllVehicles = async (): Promise<ApiVehicle[]> => {
-    const response = await fetch(`${API_BASE_URL}/vehicles/all`, {
+    const response = await fetch(`${API_BASE_URL}/vehicles/all?partial=true`, {
         method: "GET",
         headers: jsonHeaders,
     });
     if (!response.ok) {
         throw new Error(`Failed to load all vehicles (${response.status})`);
     }
-    return response.json();
+    const result: ApiVehiclesResult = await response.json();
+    if (result.partial) {
+        const routes = result.errors.flatMap((err) => err.routes);
+        console.warn(`Some routes could not be loaded: ${routes.join(", ")}`);
+    }
+    return result.vehicles;
 };
 
 export type ApiRouteStats = {
     routeNumber: string;
     routeName: string;
+    directions: Record<string, number>;
     northEastbound: number;
     southWestbound: number;
+    unknownDirection: number;
     totalActive: number;
+    crowding: {
+        empty: number;
+        half: number;
+        full: number;
+        unknown: number;
+    };
+    bunches: number;
+    bunchedVehicles: number;
 };
 
 export const fetchRouteStats = async (): Promise<ApiRouteStats[]> => {
@@ -1,4 +1,5 @@
-import { useQuery } from "@tanstack/react-query";
+import { useQuery, useQueryClient } from "@tanstack/react-query";
+import { useEffect, useState } from "react";
 import {
     fetchAllVehicles,
     fetchConfig,
@@ -9,9 +10,11 @@ import {
     fetchRoutes,
     fetchRouteStats,
     fetchVehicles,
+    openVehicleStream,
     type ApiRoute,
     type ApiRouteStats,
     type ApiVehicle,
+    type ApiVehiclesResult,
     type ClientConfig,
     type DailyTotal,
     type MonthlyTotal,
@@ -32,16 +35,39 @@ export const useRoutesQuery = () =>
         staleTime: 5 * 60 * 1000,
     });
 
+// Keeps one SSE connection open for the selected routes and writes each
+// snapshot into the query cache. Polling only runs while the stream is down,
+// e.g. when the backend has background polling disabled.
 export const useVehiclesQuery = (routeIds: string[]) => {
     const normalized = [...routeIds]
         .map((rt) => rt.trim())
         .filter(Boolean)
         .sort();
+    const streamKey = normalized.join(",");
+    const queryClient = useQueryClient();
+    const [streaming, setStreaming] = useState(false);
+
+    useEffect(() => {
+        if (!streamKey) return;
+        const routes = streamKey.split(",");
+        const source = openVehicleStream(routes);
+        source.onopen = () => setStreaming(true);
+        source.onerror = () => setStreaming(false);
+        source.addEventListener("vehicles", (event) => {
+            const result: ApiVehiclesResult = JSON.parse((event as MessageEvent<string>).data);
+            queryClient.setQueryData(["vehicles", routes], result.vehicles);
+        });
+        return () => {
+            source.close();
+            setStreaming(false);
+        };
+    }, [streamKey, queryClient]);
+
     return useQuery<ApiVehicle[]>({
         queryKey: ["vehicles", normalized],
         queryFn: () => fetchVehicles(normalized),
         enabled: normalized.length > 0,
-        refetchInterval: 15000,
+        refetchInterval: streaming ? false : 15000,
         staleTime: 10 * 1000,
     });
 };
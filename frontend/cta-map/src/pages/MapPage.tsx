@@ -65,6 +65,13 @@ const defaultToggleState: DisplayToggleState = {
 
 const defaultFavoriteRoutes = ["151"];
 
+const PASSENGER_LOAD_LABELS = {
+    EMPTY: "Plenty of seats",
+    HALF_EMPTY: "Some seats",
+    FULL: "Full",
+    "N/A": "Unknown",
+} as const;
+
 const getStoredRouteIds = (key: string, fallback: string[] = []) => {
     if (typeof window === "undefined") return fallback;
     try {
@@ -503,6 +510,12 @@ const MapPage = () => {
                                     <br />
                                     Heading: {vehicle.heading || "0"}°
                                     <br />
+                                    {vehicle.passengerLoad && vehicle.passengerLoad !== "N/A" && (
+                                        <>
+                                            Crowding: {PASSENGER_LOAD_LABELS[vehicle.passengerLoad]}
+                                            <br />
+                                        </>
+                                    )}
                                     Updated: {vehicle.timestamp}
                                 </Popup>
                             </Marker>
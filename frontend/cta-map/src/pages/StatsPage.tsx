@@ -125,6 +125,12 @@ const StatsPage = () => {
             <Table.Td>{stat.routeName}</Table.Td>
             <Table.Td ta="center">{stat.northEastbound}</Table.Td>
             <Table.Td ta="center">{stat.southWestbound}</Table.Td>
+            <Table.Td ta="center">
+                {stat.crowding.full} / {stat.crowding.half} / {stat.crowding.empty}
+            </Table.Td>
+            <Table.Td ta="center">
+                {stat.bunches > 0 ? `${stat.bunches} (${stat.bunchedVehicles} buses)` : "-"}
+            </Table.Td>
             <Table.Td ta="center" fw={600}>
                 {stat.totalActive}
             </Table.Td>
@@ -364,6 +370,8 @@ const StatsPage = () => {
                                     </Table.Th>
                                     <Table.Th ta="center">North/Eastbound</Table.Th>
                                     <Table.Th ta="center">South/Westbound</Table.Th>
+                                    <Table.Th ta="center">Full / Half / Empty</Table.Th>
+                                    <Table.Th ta="center">Bunches</Table.Th>
                                     <Table.Th ta="center">
                                         <UnstyledButton
                                             onClick={() => handleSort("totalActive")}